@@ -0,0 +1,362 @@
+package shellspy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// ErrAuthFailed is returned by an [Authenticator] when the credentials
+// supplied by the user are wrong.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Identity describes an authenticated operator.
+type Identity struct {
+	// Username is empty when the server uses a single shared password.
+	Username string `json:"username"`
+	// Attributes holds any further details the authenticator knows.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Authenticator challenges a newly connected user for credentials.
+// Authenticate reads from and writes to conn as needed, returning the
+// user's [Identity] on success. On failure it returns an error wrapping
+// [ErrAuthFailed] for bad credentials, or any other error if the
+// challenge could not be completed. The returned Identity may still
+// carry the attempted username on failure so it can be logged. Telling
+// the user their credentials were rejected is left to the caller, so
+// that a banned user gets the same reply whatever they supply.
+type Authenticator interface {
+	Authenticate(conn io.ReadWriter, remoteAddr net.Addr) (Identity, error)
+}
+
+// PasswordAuthenticator challenges for a single shared password, which
+// is compared against Hash if set and Password otherwise.
+type PasswordAuthenticator struct {
+	Password string
+	Hash     string
+}
+
+// Authenticate implements [Authenticator].
+func (a PasswordAuthenticator) Authenticate(conn io.ReadWriter, remoteAddr net.Addr) (Identity, error) {
+	password, err := Prompt(conn, "Enter Password: ")
+	if err != nil {
+		return Identity{}, err
+	}
+	if !a.check(password) {
+		return Identity{}, ErrAuthFailed
+	}
+	return Identity{}, nil
+}
+
+// check reports whether password matches. Both comparisons take
+// constant time regardless of where the mismatch occurs.
+func (a PasswordAuthenticator) check(password string) bool {
+	if a.Hash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(a.Hash), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+}
+
+// UsersAuthenticator challenges for a username and that user's
+// password, checked against a map of usernames to bcrypt hashes such as
+// the one returned by [LoadUsersFile].
+type UsersAuthenticator struct {
+	Users map[string]string
+}
+
+// Authenticate implements [Authenticator].
+func (a UsersAuthenticator) Authenticate(conn io.ReadWriter, remoteAddr net.Addr) (Identity, error) {
+	username, err := Prompt(conn, "Enter Username: ")
+	if err != nil {
+		return Identity{}, err
+	}
+	identity := Identity{Username: username}
+	password, err := Prompt(conn, "Enter Password: ")
+	if err != nil {
+		return identity, err
+	}
+	if !a.check(username, password) {
+		return identity, ErrAuthFailed
+	}
+	return identity, nil
+}
+
+// dummyHash is compared against when an unknown username is supplied,
+// so that probing for valid usernames takes as long as a real login.
+var dummyHash = []byte("$2a$10$62DdvxWze.esaMkO8H/Qw.ZLhKhJ9ZadmOtOilrm.KmTuFOwFVViq")
+
+func (a UsersAuthenticator) check(username, password string) bool {
+	hash, ok := a.Users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// DefaultAuthCommandTimeout is used by [CommandAuthenticator] when no
+// Timeout is set.
+const DefaultAuthCommandTimeout = 10 * time.Second
+
+// CommandAuthenticator challenges for a username and password and
+// delegates the decision to an external executable at Path, similar to
+// sshd's AuthorizedKeysCommand. The command receives the username,
+// password and remote address on separate lines of its standard input,
+// and the username and remote address in the SHELLSPY_USERNAME and
+// SHELLSPY_REMOTE_ADDR environment variables. Exit status 0 accepts the
+// login, in which case the command must print a JSON encoded [Identity]
+// to standard output. Any other exit status rejects it. The command is
+// killed if it runs for longer than Timeout.
+type CommandAuthenticator struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+// Authenticate implements [Authenticator].
+func (a CommandAuthenticator) Authenticate(conn io.ReadWriter, remoteAddr net.Addr) (Identity, error) {
+	username, err := Prompt(conn, "Enter Username: ")
+	if err != nil {
+		return Identity{}, err
+	}
+	identity := Identity{Username: username}
+	password, err := Prompt(conn, "Enter Password: ")
+	if err != nil {
+		return identity, err
+	}
+	addr := ""
+	if remoteAddr != nil {
+		addr = remoteAddr.String()
+	}
+	result, err := a.run(username, password, addr)
+	if err != nil {
+		return identity, err
+	}
+	if result.Username == "" {
+		result.Username = username
+	}
+	return result, nil
+}
+
+func (a CommandAuthenticator) run(username, password, addr string) (Identity, error) {
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = DefaultAuthCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, a.Path, a.Args...)
+	cmd.Env = append(os.Environ(), "SHELLSPY_USERNAME="+username, "SHELLSPY_REMOTE_ADDR="+addr)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n" + addr + "\n")
+	// Writing to a file rather than a buffer means Run returns as soon as
+	// the command is killed, even if it left children holding stdout.
+	stdout, err := os.CreateTemp("", "shellspy-auth-")
+	if err != nil {
+		return Identity{}, err
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	cmd.Stdout = stdout
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return Identity{}, fmt.Errorf("auth command %s timed out after %s", a.Path, timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return Identity{}, fmt.Errorf("%w: auth command %s exited with status %d", ErrAuthFailed, a.Path, exitErr.ExitCode())
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("auth command %s failed: %w", a.Path, err)
+	}
+	output, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		return Identity{}, err
+	}
+	var identity Identity
+	err = json.Unmarshal(output, &identity)
+	if err != nil {
+		return Identity{}, fmt.Errorf("auth command %s printed invalid identity %q: %w", a.Path, bytes.TrimSpace(output), err)
+	}
+	return identity, nil
+}
+
+// Prompt writes prompt on its own line to rw and returns the next line
+// read from it. It reads a byte at a time so that nothing after the
+// line is consumed, leaving any further input for the session.
+func Prompt(rw io.ReadWriter, prompt string) (string, error) {
+	fmt.Fprintln(rw, prompt)
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := rw.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return strings.TrimSuffix(string(line), "\r"), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// HashPassword returns a bcrypt hash of password suitable for
+// [Server.PasswordHash], the PASSWORD_HASH environment variable or
+// a users file.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func validatePasswordHash(hash string) error {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+// LoadUsersFile reads an htpasswd style file of "username:bcrypt-hash"
+// lines, as produced by `htpasswd -B` or `shellspysrv hash-password`.
+// Blank lines and lines starting with # are ignored. Usernames may only
+// contain letters, digits, '.', '_' and '-' as they become part of
+// transcript file names.
+func LoadUsersFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	scan := bufio.NewScanner(f)
+	lineNumber := 0
+	for scan.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, lineNumber)
+		}
+		if !validUsername(username) {
+			return nil, fmt.Errorf("%s:%d: invalid username %q", path, lineNumber, username)
+		}
+		err := validatePasswordHash(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid hash for %s: %w", path, lineNumber, username, err)
+		}
+		users[username] = hash
+	}
+	if scan.Err() != nil {
+		return nil, scan.Err()
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s: no users found", path)
+	}
+	return users, nil
+}
+
+func validUsername(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, r := range username {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '.' || r == '_' || r == '-':
+		default:
+			return false
+		}
+	}
+	return username != "." && username != ".."
+}
+
+// safeFileName replaces anything in name that [validUsername] would
+// reject, so usernames from any [Authenticator] can be used in paths.
+func safeFileName(name string) string {
+	if validUsername(name) {
+		return name
+	}
+	safe := []rune(name)
+	for i, r := range safe {
+		if !validUsername(string(r)) {
+			safe[i] = '_'
+		}
+	}
+	if !validUsername(string(safe)) {
+		return "_"
+	}
+	return string(safe)
+}
+
+// HashPasswordInstance reads a password from standard input and prints
+// its hash. When standard input is a terminal the password is not
+// echoed and must be entered twice.
+func HashPasswordInstance() int {
+	password, err := readPassword(os.Stdin, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "password must not be empty")
+		return 1
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+func readPassword(input *os.File, prompt io.Writer) (string, error) {
+	fd := int(input.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(input).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(prompt, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(prompt)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(prompt, "Confirm password: ")
+	confirm, err := term.ReadPassword(fd)
+	fmt.Fprintln(prompt)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(password, confirm) != 1 {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(password), nil
+}
@@ -0,0 +1,185 @@
+package shellspy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// builtin is a command the session runs itself, because it changes the
+// state of the session rather than that of a separate process. Output
+// goes to stdout and a non-nil error means the command failed.
+type builtin func(s *session, args []string, stdout io.Writer) error
+
+var builtins = map[string]builtin{
+	"cd":     builtinCd,
+	"pwd":    builtinPwd,
+	"pushd":  builtinPushd,
+	"popd":   builtinPopd,
+	"export": builtinExport,
+	"unset":  builtinUnset,
+	"env":    builtinEnv,
+}
+
+// builtin returns the builtin named by args[0], if there is one. With
+// arguments env is left to the env program, which runs a command in a
+// modified environment.
+func (s *session) builtin(args []string) (builtin, bool) {
+	if args[0] == "env" && len(args) > 1 {
+		return nil, false
+	}
+	b, ok := builtins[args[0]]
+	return b, ok
+}
+
+// builtinCd changes the working directory to the one given, to $HOME
+// if none is given, or back to the previous one for "-".
+func builtinCd(s *session, args []string, stdout io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("cd: too many arguments")
+	}
+	dir := ""
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	switch dir {
+	case "":
+		dir = s.env["HOME"]
+		if dir == "" {
+			return errors.New("cd: HOME not set")
+		}
+	case "-":
+		if s.oldDir == "" {
+			return errors.New("cd: no previous directory")
+		}
+		dir = s.oldDir
+		fmt.Fprintln(stdout, dir)
+	}
+	return s.chdir("cd", dir)
+}
+
+func builtinPwd(s *session, args []string, stdout io.Writer) error {
+	fmt.Fprintln(stdout, s.cwd)
+	return nil
+}
+
+// builtinPushd saves the working directory on the directory stack and
+// changes to the one given, or with no arguments swaps the working
+// directory with the top of the stack.
+func builtinPushd(s *session, args []string, stdout io.Writer) error {
+	if len(args) > 1 {
+		return errors.New("pushd: too many arguments")
+	}
+	previous := s.cwd
+	if len(args) == 0 {
+		if len(s.dirStack) == 0 {
+			return errors.New("pushd: no other directory")
+		}
+		top := s.dirStack[len(s.dirStack)-1]
+		err := s.chdir("pushd", top)
+		if err != nil {
+			return err
+		}
+		s.dirStack[len(s.dirStack)-1] = previous
+	} else {
+		err := s.chdir("pushd", args[0])
+		if err != nil {
+			return err
+		}
+		s.dirStack = append(s.dirStack, previous)
+	}
+	s.printDirStack(stdout)
+	return nil
+}
+
+// builtinPopd changes to the directory on top of the directory stack,
+// removing it from the stack.
+func builtinPopd(s *session, args []string, stdout io.Writer) error {
+	if len(args) > 0 {
+		return errors.New("popd: too many arguments")
+	}
+	if len(s.dirStack) == 0 {
+		return errors.New("popd: directory stack empty")
+	}
+	top := s.dirStack[len(s.dirStack)-1]
+	err := s.chdir("popd", top)
+	if err != nil {
+		return err
+	}
+	s.dirStack = s.dirStack[:len(s.dirStack)-1]
+	s.printDirStack(stdout)
+	return nil
+}
+
+// printDirStack prints the working directory followed by the
+// directory stack, most recently pushed first, as dirs does.
+func (s *session) printDirStack(stdout io.Writer) {
+	dirs := []string{s.cwd}
+	for i := len(s.dirStack) - 1; i >= 0; i-- {
+		dirs = append(dirs, s.dirStack[i])
+	}
+	fmt.Fprintln(stdout, strings.Join(dirs, " "))
+}
+
+// chdir makes dir, relative to the current working directory, the
+// working directory for later commands in the session.
+func (s *session) chdir(name, dir string) error {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.cwd, dir)
+	}
+	dir = filepath.Clean(dir)
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %s: no such file or directory", name, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: %s: not a directory", name, dir)
+	}
+	s.oldDir = s.cwd
+	s.cwd = dir
+	return nil
+}
+
+// builtinExport sets each NAME=value given in the session environment,
+// or with no arguments prints the environment. As every session
+// variable is passed to commands, a NAME alone has no effect.
+func builtinExport(s *session, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return builtinEnv(s, args, stdout)
+	}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !validEnvName(name) {
+			return fmt.Errorf("export: %s: not a valid identifier", arg)
+		}
+		if ok {
+			s.setEnv(name, value)
+		}
+	}
+	return nil
+}
+
+// builtinUnset removes each variable named from the session environment.
+func builtinUnset(s *session, args []string, stdout io.Writer) error {
+	for _, name := range args {
+		if !validEnvName(name) {
+			return fmt.Errorf("unset: %s: not a valid identifier", name)
+		}
+		s.unsetEnv(name)
+	}
+	return nil
+}
+
+// builtinEnv prints the session environment, one NAME=value per line.
+func builtinEnv(s *session, args []string, stdout io.Writer) error {
+	for _, kv := range s.environ() {
+		fmt.Fprintln(stdout, kv)
+	}
+	return nil
+}
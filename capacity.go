@@ -0,0 +1,133 @@
+package shellspy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// capacity holds the counters behind [Server.MaxConnections],
+// [Server.MaxSessions] and their per IP equivalents. It is guarded by
+// the server mutex.
+type capacity struct {
+	conns         int
+	connsPerIP    map[string]int
+	sessions      int
+	sessionsPerIP map[string]int
+	queued        int
+	sessionFreed  chan struct{}
+}
+
+// acquireConn reserves a connection slot for ip, returning a reason
+// if the connection limits have been reached.
+func (s *Server) acquireConn(ip string) (reason string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &s.capacity
+	if s.MaxConnections > 0 && c.conns >= s.MaxConnections {
+		return fmt.Sprintf("%d connections open", c.conns), false
+	}
+	if s.MaxConnectionsPerIP > 0 && c.connsPerIP[ip] >= s.MaxConnectionsPerIP {
+		return fmt.Sprintf("%d connections open from this address", c.connsPerIP[ip]), false
+	}
+	if c.connsPerIP == nil {
+		c.connsPerIP = make(map[string]int)
+	}
+	c.conns++
+	c.connsPerIP[ip]++
+	return "", true
+}
+
+func (s *Server) releaseConn(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &s.capacity
+	c.conns--
+	c.connsPerIP[ip]--
+	if c.connsPerIP[ip] == 0 {
+		delete(c.connsPerIP, ip)
+	}
+}
+
+// acquireSession reserves a session slot for the logged in user on
+// conn. If the session limits have been reached and
+// [Server.SessionQueueSize] allows it, the user waits up to
+// [Server.SessionQueueTimeout] for another session to end.
+func (s *Server) acquireSession(conn net.Conn, ip string) bool {
+	s.mu.Lock()
+	reason, ok := s.takeSession(ip)
+	if ok {
+		s.mu.Unlock()
+		return true
+	}
+	if s.capacity.queued >= s.SessionQueueSize {
+		s.mu.Unlock()
+		fmt.Fprintln(conn, "Server busy: too many sessions, try again later")
+		s.Logf("SESSION REJECTED from %s: server busy (%s)\n", conn.RemoteAddr(), reason)
+		return false
+	}
+	s.capacity.queued++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.capacity.queued--
+		s.mu.Unlock()
+	}()
+	fmt.Fprintln(conn, "Server busy: waiting for a free session")
+	s.Logf("SESSION QUEUED from %s: server busy (%s)\n", conn.RemoteAddr(), reason)
+	timeout := time.NewTimer(s.SessionQueueTimeout)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		if _, ok := s.takeSession(ip); ok {
+			s.mu.Unlock()
+			return true
+		}
+		if s.capacity.sessionFreed == nil {
+			s.capacity.sessionFreed = make(chan struct{})
+		}
+		freed := s.capacity.sessionFreed
+		s.mu.Unlock()
+		select {
+		case <-freed:
+		case <-timeout.C:
+			fmt.Fprintln(conn, "Server busy: no session became free, try again later")
+			s.Logf("SESSION REJECTED from %s: timed out waiting in queue\n", conn.RemoteAddr())
+			return false
+		case <-s.sessionContext().Done():
+			return false
+		}
+	}
+}
+
+// takeSession must be called with s.mu held.
+func (s *Server) takeSession(ip string) (reason string, ok bool) {
+	c := &s.capacity
+	if s.MaxSessions > 0 && c.sessions >= s.MaxSessions {
+		return fmt.Sprintf("%d sessions active", c.sessions), false
+	}
+	if s.MaxSessionsPerIP > 0 && c.sessionsPerIP[ip] >= s.MaxSessionsPerIP {
+		return fmt.Sprintf("%d sessions active from this address", c.sessionsPerIP[ip]), false
+	}
+	if c.sessionsPerIP == nil {
+		c.sessionsPerIP = make(map[string]int)
+	}
+	c.sessions++
+	c.sessionsPerIP[ip]++
+	return "", true
+}
+
+func (s *Server) releaseSession(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &s.capacity
+	c.sessions--
+	c.sessionsPerIP[ip]--
+	if c.sessionsPerIP[ip] == 0 {
+		delete(c.sessionsPerIP, ip)
+	}
+	if c.sessionFreed != nil {
+		close(c.sessionFreed)
+		c.sessionFreed = nil
+	}
+}
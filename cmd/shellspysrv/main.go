@@ -1,9 +1,14 @@
 package main
 
 import (
+	"os"
+
 	"github.com/mr-joshcrane/shellspy"
 )
 
 func main() {
-	shellspy.ServerInstance()
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(shellspy.HashPasswordInstance())
+	}
+	os.Exit(shellspy.ServerInstance())
 }
@@ -0,0 +1,261 @@
+package shellspy
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sensitiveEnv lists the variables of a [Server] process that are not
+// passed on to sessions by default, as they hold its credentials.
+var sensitiveEnv = []string{"PASSWORD", "PASSWORD_HASH"}
+
+// serverEnv returns the environment of the server process without any
+// [sensitiveEnv] variables.
+func serverEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		sensitive := false
+		for _, s := range sensitiveEnv {
+			sensitive = sensitive || name == s
+		}
+		if !sensitive {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// sessionEnv returns the environment sessions start with.
+func (s *Server) sessionEnv() []string {
+	if s.Env != nil {
+		return s.Env
+	}
+	return serverEnv()
+}
+
+// LoadEnvFile reads NAME=value lines from path, as used for
+// [Server.Env]. Blank lines and lines starting with # are ignored.
+func LoadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	env := []string{}
+	scan := bufio.NewScanner(f)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, ok := strings.Cut(line, "=")
+		if !ok || !validEnvName(name) {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		env = append(env, line)
+	}
+	return env, scan.Err()
+}
+
+// envMap converts a list of NAME=value strings into a map. Later
+// entries win.
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		m[name] = value
+	}
+	return m
+}
+
+// environ returns the session environment as sorted NAME=value strings,
+// with PWD set to the working directory.
+func (s *session) environ() []string {
+	env := make([]string, 0, len(s.env)+1)
+	for name, value := range s.env {
+		if name != "PWD" {
+			env = append(env, name+"="+value)
+		}
+	}
+	env = append(env, "PWD="+s.cwd)
+	sort.Strings(env)
+	return env
+}
+
+// lookupEnv returns the value of a variable for expansion. $? is the
+// exit status of the last command.
+func (s *session) lookupEnv(name string) string {
+	switch name {
+	case "?":
+		return strconv.Itoa(s.lastExitCode)
+	case "PWD":
+		return s.cwd
+	}
+	return s.env[name]
+}
+
+// setEnv sets a variable in the session environment, noting the change
+// in the transcript.
+func (s *session) setEnv(name, value string) {
+	s.env[name] = value
+	s.record(event{Type: eventEnv, Name: name, Value: &value})
+}
+
+// unsetEnv removes a variable from the session environment, noting the
+// change in the transcript.
+func (s *session) unsetEnv(name string) {
+	delete(s.env, name)
+	s.record(event{Type: eventEnv, Name: name})
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && '0' <= r && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// expandEnv replaces $NAME, ${NAME} and $? in line with their values
+// from lookup, except within single quotes or when the $ is escaped
+// with a backslash. Expanded values are escaped so that quotes and
+// backslashes in them are taken literally when the line is split into
+// arguments, but unquoted values are still split on whitespace.
+func expandEnv(line string, lookup func(string) string) (string, error) {
+	var out strings.Builder
+	single, double := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\'' && !double:
+			single = !single
+		case c == '"' && !single:
+			double = !double
+		case c == '\\' && !single && i+1 < len(line):
+			// The splitter keeps the backslash in \$ within double
+			// quotes, so drop it here.
+			if !double || line[i+1] != '$' {
+				out.WriteByte(c)
+			}
+			i++
+			c = line[i]
+		case c == '$' && !single:
+			name, n, err := envReference(line[i+1:])
+			if err != nil {
+				return "", err
+			}
+			if n > 0 {
+				out.WriteString(escapeValue(lookup(name), double))
+				i += n
+				continue
+			}
+		}
+		out.WriteByte(c)
+	}
+	return out.String(), nil
+}
+
+// envReference parses the variable name following a $ at the start of
+// rest, returning the name and how many bytes it took up, or zero if
+// rest does not start with one.
+func envReference(rest string) (name string, n int, err error) {
+	if strings.HasPrefix(rest, "?") {
+		return "?", 1, nil
+	}
+	if strings.HasPrefix(rest, "{") {
+		end := strings.IndexByte(rest, '}')
+		if end < 0 || !validEnvName(rest[1:end]) && rest[1:end] != "?" {
+			return "", 0, fmt.Errorf("bad substitution in [$%s]", rest)
+		}
+		return rest[1:end], end + 1, nil
+	}
+	for n < len(rest) && validEnvName(rest[:n+1]) {
+		n++
+	}
+	return rest[:n], n, nil
+}
+
+// escapeValue escapes the characters in value that would otherwise be
+// interpreted when splitting a line into arguments and operators.
+func escapeValue(value string, double bool) string {
+	special := `\"'|<>;&`
+	if double {
+		special = `\"`
+	}
+	var out strings.Builder
+	for _, r := range value {
+		if strings.ContainsRune(special, r) {
+			out.WriteByte('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// command returns a command to run args in the session working
+// directory and environment, looking up the program in the session
+// PATH rather than that of the process.
+func (s *session) command(args []string) (*exec.Cmd, error) {
+	path, err := s.lookPath(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &exec.Cmd{Path: path, Args: args, Dir: s.cwd, Env: s.environ()}, nil
+}
+
+// lookPath finds the executable file named by name as [exec.LookPath]
+// does, but relative to the session working directory and PATH.
+func (s *session) lookPath(name string) (string, error) {
+	if strings.Contains(name, string(filepath.Separator)) {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.cwd, path)
+		}
+		err := executable(path)
+		if err != nil {
+			return "", &exec.Error{Name: name, Err: err}
+		}
+		return path, nil
+	}
+	for _, dir := range filepath.SplitList(s.env["PATH"]) {
+		if dir == "" {
+			dir = "."
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(s.cwd, dir)
+		}
+		path := filepath.Join(dir, name)
+		if executable(path) == nil {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+// executable reports why path is not an executable file, if it is not.
+func executable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || runtime.GOOS != "windows" && info.Mode()&0o111 == 0 {
+		return fs.ErrPermission
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package shellspy
+
+import "os"
+
+// exitCode returns the exit status of the process.
+func exitCode(state *os.ProcessState) int {
+	return state.ExitCode()
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package shellspy
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitCode returns the exit status of the process, or as in sh, 128
+// plus the signal number if it was killed by a signal.
+func exitCode(state *os.ProcessState) int {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,133 @@
+package shellspy
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// expandGlobs replaces each argument of st that is a glob pattern with
+// the paths it matches, relative to the session working directory. As
+// in sh, a pattern that matches nothing is left as it is.
+func (s *session) expandGlobs(st stage) stage {
+	var args []string
+	for i, arg := range st.args {
+		if st.patterns[i] == "" {
+			args = append(args, arg)
+			continue
+		}
+		matches := glob(s.cwd, st.patterns[i])
+		if len(matches) == 0 {
+			args = append(args, arg)
+			continue
+		}
+		args = append(args, matches...)
+	}
+	st.args = args
+	return st
+}
+
+// glob returns the sorted paths matching pattern, which is relative to
+// dir unless it is absolute. It works like [filepath.Glob], except that
+// a "**" path element matches any number of directories, or everything
+// below them if it is the last element, and names starting with a dot
+// are only matched by a pattern that does too.
+func glob(dir, pattern string) []string {
+	prefix := ""
+	if strings.HasPrefix(pattern, "/") {
+		dir, prefix = "/", "/"
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	var matches []string
+	globIn(dir, prefix, strings.Split(pattern, "/"), &matches)
+	sort.Strings(matches)
+	return matches
+}
+
+// globIn adds the paths under dir matching the path elements in
+// elems to matches, prefixing them with prefix.
+func globIn(dir, prefix string, elems []string, matches *[]string) {
+	elem, rest := elems[0], elems[1:]
+	if !hasGlobMeta(elem) {
+		name := unescapeGlob(elem)
+		path := filepath.Join(dir, name)
+		if len(rest) == 0 {
+			if _, err := os.Lstat(path); err == nil {
+				*matches = append(*matches, prefix+name)
+			}
+			return
+		}
+		globIn(path, prefix+name+"/", rest, matches)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	if elem == "**" {
+		if len(rest) > 0 {
+			globIn(dir, prefix, rest, matches)
+		}
+		// Like bash with globstar set, symbolic links to directories are
+		// not followed, which also rules out cycles.
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			if len(rest) == 0 {
+				*matches = append(*matches, prefix+name)
+			}
+			if entry.IsDir() {
+				globIn(filepath.Join(dir, name), prefix+name+"/", elems, matches)
+			}
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(elem, ".") {
+			continue
+		}
+		ok, err := filepath.Match(elem, name)
+		if err != nil || !ok {
+			continue
+		}
+		if len(rest) == 0 {
+			*matches = append(*matches, prefix+name)
+		} else if isDir(filepath.Join(dir, name)) {
+			globIn(filepath.Join(dir, name), prefix+name+"/", rest, matches)
+		}
+	}
+}
+
+// hasGlobMeta reports whether elem contains unescaped glob characters.
+func hasGlobMeta(elem string) bool {
+	for i := 0; i < len(elem); i++ {
+		switch elem[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeGlob removes the backslashes escaping characters in elem.
+func unescapeGlob(elem string) string {
+	var out strings.Builder
+	for i := 0; i < len(elem); i++ {
+		if elem[i] == '\\' && i+1 < len(elem) {
+			i++
+		}
+		out.WriteByte(elem[i])
+	}
+	return out.String()
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -3,9 +3,10 @@ module github.com/mr-joshcrane/shellspy
 go 1.19
 
 require (
-	bitbucket.org/creachadair/shell v0.0.7
 	github.com/google/go-cmp v0.5.9
 	github.com/rogpeppe/go-internal v1.10.0
+	golang.org/x/crypto v0.11.0
+	golang.org/x/term v0.10.0
 )
 
 require (
@@ -32,8 +33,8 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.13.0 // indirect
 	github.com/subosito/gotenv v1.4.1 // indirect
-	golang.org/x/sys v0.7.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
 	golang.org/x/tools v0.6.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
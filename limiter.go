@@ -0,0 +1,285 @@
+package shellspy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// LoginLimiter protects a [Server] against password guessing. It counts
+// failed logins per remote IP and per username within a sliding Window,
+// slows down each further failure with an exponentially growing delay,
+// and bans the IP or username for BanDuration once MaxFailures is
+// reached. Bans are held in memory unless StatePath is set, in which
+// case they are saved there and survive restarts via [LoginLimiter.Load].
+//
+// Failures older than the Window are forgotten. As usernames are chosen
+// by the client, at most MaxTracked IPs and usernames have their
+// failures counted at once, forgetting those that failed least recently
+// to make room. Zero means no limit.
+type LoginLimiter struct {
+	MaxFailures int
+	Window      time.Duration
+	BanDuration time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxTracked  int
+	StatePath   string
+	Logger      io.Writer
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	pruned   time.Time
+	bans     map[string]time.Time
+}
+
+// NewLoginLimiter returns a [LoginLimiter] that bans for 15 minutes
+// after 5 failures in 10 minutes, delaying failed attempts from one
+// second up to 30 seconds, and tracks up to 10000 IPs and usernames.
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		MaxFailures: 5,
+		Window:      10 * time.Minute,
+		BanDuration: 15 * time.Minute,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		MaxTracked:  10000,
+		Logger:      os.Stdout,
+	}
+}
+
+// Banned reports whether either the remote ip or the username is
+// currently banned, and if so until when. Empty arguments are ignored.
+func (l *LoginLimiter) Banned(ip, username string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range limiterKeys(ip, username) {
+		until, ok := l.bans[key]
+		if ok && now.Before(until) {
+			return until, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Failure records a failed login from ip for username and returns how
+// long the caller should wait before responding. It starts a ban for
+// any key that has reached MaxFailures within the Window.
+func (l *LoginLimiter) Failure(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[string][]time.Time)
+	}
+	now := time.Now()
+	l.prune(now)
+	worst := 0
+	for _, key := range limiterKeys(ip, username) {
+		if _, ok := l.failures[key]; !ok && l.MaxTracked > 0 && len(l.failures) >= l.MaxTracked {
+			l.forgetLeastRecent()
+		}
+		recent := []time.Time{now}
+		for _, t := range l.failures[key] {
+			if now.Sub(t) < l.Window {
+				recent = append(recent, t)
+			}
+		}
+		l.failures[key] = recent
+		if len(recent) > worst {
+			worst = len(recent)
+		}
+		if l.MaxFailures > 0 && len(recent) >= l.MaxFailures {
+			until := now.Add(l.BanDuration)
+			l.logf("LOGIN BAN START %s until %s after %d failures\n", key, until.Format(time.RFC3339), len(recent))
+			l.ban(key, until)
+			delete(l.failures, key)
+		}
+	}
+	return l.delay(worst)
+}
+
+// prune forgets failures that are outside the Window, at most once
+// per Window. It must be called with l.mu held.
+func (l *LoginLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.Window {
+		return
+	}
+	l.pruned = now
+	for key, times := range l.failures {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < l.Window {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.failures, key)
+		} else {
+			l.failures[key] = recent
+		}
+	}
+}
+
+// forgetLeastRecent forgets the failures of the key whose last failure
+// is the oldest. It must be called with l.mu held.
+func (l *LoginLimiter) forgetLeastRecent() {
+	oldest, last := "", time.Time{}
+	for key, times := range l.failures {
+		// The most recent failure is always first.
+		if oldest == "" || times[0].Before(last) {
+			oldest, last = key, times[0]
+		}
+	}
+	delete(l.failures, oldest)
+}
+
+// Success forgets previous failures for ip and username.
+func (l *LoginLimiter) Success(ip, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range limiterKeys(ip, username) {
+		delete(l.failures, key)
+	}
+}
+
+// Load restores bans saved to StatePath by a previous process.
+// A missing file is not an error.
+func (l *LoginLimiter) Load() error {
+	if l.StatePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans map[string]time.Time
+	err = json.Unmarshal(data, &bans)
+	if err != nil {
+		return fmt.Errorf("reading login bans from %s: %w", l.StatePath, err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, until := range bans {
+		if now.Before(until) {
+			l.logf("LOGIN BAN RESTORED %s until %s\n", key, until.Format(time.RFC3339))
+			l.ban(key, until)
+		}
+	}
+	return nil
+}
+
+// delay returns BaseDelay doubled for every failure after the first,
+// capped at MaxDelay.
+func (l *LoginLimiter) delay(failures int) time.Duration {
+	d := l.BaseDelay
+	for i := 1; i < failures && (l.MaxDelay <= 0 || d < l.MaxDelay); i++ {
+		d *= 2
+	}
+	if l.MaxDelay > 0 && d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+// ban records and persists a ban on key, scheduling its end.
+// It must be called with l.mu held.
+func (l *LoginLimiter) ban(key string, until time.Time) {
+	if l.bans == nil {
+		l.bans = make(map[string]time.Time)
+	}
+	l.bans[key] = until
+	l.save()
+	time.AfterFunc(time.Until(until), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.bans[key] != until {
+			return
+		}
+		delete(l.bans, key)
+		l.logf("LOGIN BAN END %s\n", key)
+		l.save()
+	})
+}
+
+// save must be called with l.mu held.
+func (l *LoginLimiter) save() {
+	if l.StatePath == "" {
+		return
+	}
+	data, err := json.Marshal(l.bans)
+	if err == nil {
+		err = os.WriteFile(l.StatePath, data, 0o600)
+	}
+	if err != nil {
+		l.logf("Could not save login bans to %s: %s\n", l.StatePath, err)
+	}
+}
+
+func (l *LoginLimiter) logf(format string, args ...any) {
+	if l.Logger != nil {
+		fmt.Fprintf(l.Logger, format, args...)
+	}
+}
+
+func limiterKeys(ip, username string) []string {
+	var keys []string
+	if ip != "" {
+		keys = append(keys, "ip="+ip)
+	}
+	if username != "" {
+		keys = append(keys, "user="+username)
+	}
+	return keys
+}
+
+// remoteIP returns the host part of addr, or its full string form if
+// it has no port.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// loginLimiterFromEnv builds the default [LoginLimiter], overridden by
+// the LOGIN_MAX_FAILURES, LOGIN_WINDOW and LOGIN_BAN_DURATION
+// environment variables. LOGIN_MAX_FAILURES=0 disables it, and
+// LOGIN_BAN_STATE names a file to persist bans in across restarts.
+func loginLimiterFromEnv() (*LoginLimiter, error) {
+	l := NewLoginLimiter()
+	var err error
+	l.MaxFailures, err = intFromEnv("LOGIN_MAX_FAILURES", l.MaxFailures)
+	if err != nil {
+		return nil, err
+	}
+	if l.MaxFailures == 0 {
+		return nil, nil
+	}
+	l.Window, err = durationFromEnv("LOGIN_WINDOW", l.Window)
+	if err != nil {
+		return nil, err
+	}
+	l.BanDuration, err = durationFromEnv("LOGIN_BAN_DURATION", l.BanDuration)
+	if err != nil {
+		return nil, err
+	}
+	l.StatePath = os.Getenv("LOGIN_BAN_STATE")
+	err = l.Load()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,119 @@
+package shellspy
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Version is the shellspy version recorded in [SessionMetadata], as
+// found in the build information of the running binary.
+var Version = version()
+
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	const module = "github.com/mr-joshcrane/shellspy"
+	if info.Main.Path == module {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == module {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// SessionMetadata describes a session. It is written as JSON to a
+// sidecar file next to the transcript, with the same name but ending
+// ".meta.json", when the session starts and again when it ends.
+type SessionMetadata struct {
+	SessionID      string     `json:"session_id,omitempty"`
+	Identity       string     `json:"identity,omitempty"`
+	RemoteAddr     string     `json:"remote_addr,omitempty"`
+	Hostname       string     `json:"hostname"`
+	Version        string     `json:"version"`
+	Transcript     string     `json:"transcript"`
+	Format         string     `json:"format"`
+	Start          time.Time  `json:"start"`
+	End            *time.Time `json:"end,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	Commands       int        `json:"commands"`
+	FailedCommands int        `json:"failed_commands"`
+	BytesIn        int64      `json:"bytes_in"`
+	BytesOut       int64      `json:"bytes_out"`
+}
+
+// metadata describes the session so far. The reason is empty until the
+// session has ended.
+func (s *session) metadata(reason string) SessionMetadata {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	md := SessionMetadata{
+		SessionID:      s.sessionID,
+		Identity:       s.identity,
+		RemoteAddr:     s.remoteAddr,
+		Hostname:       hostname,
+		Version:        Version,
+		Transcript:     filepath.Base(s.transcriptPath),
+		Format:         s.format.String(),
+		Start:          s.stats.start,
+		Reason:         reason,
+		Commands:       s.stats.commands,
+		FailedCommands: s.stats.failed,
+		BytesIn:        s.stats.bytesIn.Load(),
+		BytesOut:       s.stats.bytesOut.Load(),
+	}
+	if reason != "" {
+		end := time.Now()
+		md.End = &end
+	}
+	return md
+}
+
+// writeMetadata replaces the contents of f with md.
+func writeMetadata(f *os.File, md SessionMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(append(data, '\n'), 0)
+	return err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,92 @@
+package shellspy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// transcriptFields matches the {field} placeholders in a
+// [Server.TranscriptTemplate], including any with names that are not
+// fields so that they can be rejected.
+var transcriptFields = regexp.MustCompile(`\{[^{}]*\}`)
+
+// ExpandTranscriptTemplate replaces the placeholders in template with
+// the matching values from fields. Values are made safe to use as a
+// single path element, with empty values becoming "_", and the result
+// must be a relative path that does not escape the directory it is
+// joined to. A [Server.TranscriptTemplate] may use {id}, {user}, {ip},
+// {date} (YYYY-MM-DD in UTC) and {hostname}, and must use {id} so that
+// every session gets a transcript of its own.
+func ExpandTranscriptTemplate(template string, fields map[string]string) (string, error) {
+	if !strings.Contains(template, "{id}") {
+		return "", fmt.Errorf("transcript template %q must include {id}", template)
+	}
+	var err error
+	path := transcriptFields.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := fields[name]
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("unknown field %s in transcript template %q", placeholder, template)
+			}
+			return ""
+		}
+		return safeFileName(value)
+	})
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Clean(path)
+	if path == "." || filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("transcript template %q must name a file inside the transcript directory", template)
+	}
+	return path, nil
+}
+
+// ValidateTranscriptTemplate reports whether template can be expanded
+// by [ExpandTranscriptTemplate].
+func ValidateTranscriptTemplate(template string) error {
+	_, err := ExpandTranscriptTemplate(template, transcriptTemplateFields("id", "user", "127.0.0.1", time.Now()))
+	return err
+}
+
+// transcriptTemplateFields returns the values available to a
+// [Server.TranscriptTemplate] for a session.
+func transcriptTemplateFields(id, user, ip string, start time.Time) map[string]string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return map[string]string{
+		"id":       id,
+		"user":     user,
+		"ip":       ip,
+		"date":     start.UTC().Format("2006-01-02"),
+		"hostname": hostname,
+	}
+}
+
+// transcriptPath returns where the transcript for session id should be
+// written, creating any directories the [Server.TranscriptTemplate]
+// calls for. If the template is invalid the default name is returned
+// along with the error.
+func (s *Server) transcriptPath(id, user, ip string) (string, error) {
+	name := id
+	if user != "" {
+		name = safeFileName(user) + "-" + name
+	}
+	path := fmt.Sprintf("%s/transcript-%s%s", s.TranscriptDirectory, name, s.TranscriptFormat.Extension())
+	if s.TranscriptTemplate == "" {
+		return path, nil
+	}
+	name, err := ExpandTranscriptTemplate(s.TranscriptTemplate, transcriptTemplateFields(id, user, ip, time.Now()))
+	if err != nil {
+		return path, err
+	}
+	path = filepath.Join(s.TranscriptDirectory, name)
+	return path, os.MkdirAll(filepath.Dir(path), 0o755)
+}
@@ -0,0 +1,227 @@
+package shellspy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// token is a word or an operator on a command line, and the offset of
+// an operator in the line. A word containing unquoted glob characters
+// also has a pattern for [glob], in which quoted ones are escaped.
+type token struct {
+	op      string
+	word    string
+	pattern string
+	pos     int
+}
+
+// operators are recognized outside quotes, longest first so that ">>" is
+// not read as two ">". Those starting with 2 only count at the start of
+// a word.
+var operators = []string{"2>&1", "2>>", "2>", "&&", "||", ">>", ">", "<", "|", ";"}
+
+// listItem is one pipeline in a list of them joined by operators, as in
+// "make && ./run || echo failed".
+type listItem struct {
+	// op joins the item to the one before: "", ";", "&&" or "||".
+	op string
+	// text is the pipeline as written, as variables in it are only
+	// expanded when it runs.
+	text string
+}
+
+// stage is one command in a pipeline, together with its redirections.
+type stage struct {
+	args []string
+	// patterns holds the glob pattern for each of args, or an empty
+	// string for those that are not patterns.
+	patterns []string
+	// redirects are applied in the order they were given, so that
+	// "2>&1 >file" leaves stderr where stdout was before the file.
+	redirects []redirect
+}
+
+// redirect is a redirection operator other than "|", such as ">" or
+// "2>&1", and the file it names, if any.
+type redirect struct {
+	op   string
+	file string
+}
+
+// lex splits line into words and operators. As in sh, single quotes
+// keep everything up to the next one, double quotes allow \" and \\
+// inside, and a backslash escapes the character after it.
+func lex(line string) ([]token, error) {
+	unbalanced := fmt.Errorf("unbalanced quotes or backslashes in [%s]", line)
+	var tokens []token
+	var word, pattern strings.Builder
+	inWord, isPattern := false, false
+	endWord := func() {
+		if inWord {
+			t := token{word: word.String()}
+			if isPattern {
+				t.pattern = pattern.String()
+			}
+			tokens = append(tokens, t)
+			word.Reset()
+			pattern.Reset()
+			inWord, isPattern = false, false
+		}
+	}
+	// quoted adds characters that were quoted or escaped to the word.
+	quoted := func(s string) {
+		word.WriteString(s)
+		for i := 0; i < len(s); i++ {
+			if strings.IndexByte(`*?[]\`, s[i]) >= 0 {
+				pattern.WriteByte('\\')
+			}
+			pattern.WriteByte(s[i])
+		}
+		inWord = true
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			endWord()
+		case '\\':
+			if i+1 == len(line) {
+				return nil, unbalanced
+			}
+			i++
+			quoted(line[i : i+1])
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, unbalanced
+			}
+			quoted(line[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			inWord = true
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+					i++
+				}
+				quoted(line[i : i+1])
+			}
+			if i == len(line) {
+				return nil, unbalanced
+			}
+		default:
+			op := operatorAt(line[i:], inWord)
+			if op == "" {
+				word.WriteByte(c)
+				pattern.WriteByte(c)
+				isPattern = isPattern || c == '*' || c == '?' || c == '['
+				inWord = true
+				continue
+			}
+			endWord()
+			tokens = append(tokens, token{op: op, pos: i})
+			i += len(op) - 1
+		}
+	}
+	endWord()
+	return tokens, nil
+}
+
+// operatorAt returns the operator at the start of rest, if any.
+func operatorAt(rest string, inWord bool) string {
+	for _, op := range operators {
+		if strings.HasPrefix(rest, op) && !(inWord && op[0] == '2') {
+			return op
+		}
+	}
+	return ""
+}
+
+// parseList splits line into the pipelines it lists, checking the
+// syntax of each. A trailing ";" is allowed.
+func parseList(line string) ([]listItem, error) {
+	tokens, err := lex(line)
+	if err != nil {
+		return nil, err
+	}
+	var items []listItem
+	op, start := "", 0
+	add := func(end int) error {
+		text := strings.TrimSpace(line[start:end])
+		_, err := parsePipeline(text)
+		items = append(items, listItem{op: op, text: text})
+		return err
+	}
+	for _, t := range tokens {
+		switch t.op {
+		case ";", "&&", "||":
+			if strings.TrimSpace(line[start:t.pos]) == "" {
+				return nil, syntaxError(line, fmt.Sprintf("%q", t.op))
+			}
+			err := add(t.pos)
+			if err != nil {
+				return nil, err
+			}
+			op, start = t.op, t.pos+len(t.op)
+		}
+	}
+	if strings.TrimSpace(line[start:]) == "" {
+		if op == "&&" || op == "||" {
+			return nil, syntaxError(line, "newline")
+		}
+		return items, nil
+	}
+	err = add(len(line))
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func syntaxError(line, near string) error {
+	return fmt.Errorf("syntax error near %s in [%s]", near, line)
+}
+
+// parsePipeline splits line into the stages of a pipeline, returning
+// none if the line is blank.
+func parsePipeline(line string) ([]stage, error) {
+	tokens, err := lex(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	var stages []stage
+	var st stage
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch t.op {
+		case "":
+			st.args = append(st.args, t.word)
+			st.patterns = append(st.patterns, t.pattern)
+		case ";", "&&", "||":
+			return nil, syntaxError(line, fmt.Sprintf("%q", t.op))
+		case "|":
+			if len(st.args) == 0 {
+				return nil, syntaxError(line, `"|"`)
+			}
+			stages = append(stages, st)
+			st = stage{}
+		case "2>&1":
+			st.redirects = append(st.redirects, redirect{op: t.op})
+		default:
+			if i+1 == len(tokens) {
+				return nil, syntaxError(line, "newline")
+			}
+			i++
+			if tokens[i].op != "" {
+				return nil, syntaxError(line, fmt.Sprintf("%q", tokens[i].op))
+			}
+			st.redirects = append(st.redirects, redirect{op: t.op, file: tokens[i].word})
+		}
+	}
+	if len(st.args) == 0 {
+		return nil, syntaxError(line, "newline")
+	}
+	return append(stages, st), nil
+}
@@ -0,0 +1,19 @@
+//go:build darwin || ios
+
+package shellspy
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSS returns the peak resident set size of the process in bytes,
+// or zero if it is not known. Unlike other platforms Darwin reports it
+// in bytes already.
+func maxRSS(state *os.ProcessState) int64 {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	return int64(usage.Maxrss)
+}
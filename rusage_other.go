@@ -0,0 +1,11 @@
+//go:build !unix
+
+package shellspy
+
+import "os"
+
+// maxRSS returns zero, as the peak resident set size of a process is
+// not available on this platform.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
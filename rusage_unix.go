@@ -0,0 +1,18 @@
+//go:build unix && !darwin && !ios
+
+package shellspy
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSS returns the peak resident set size of the process in bytes,
+// or zero if it is not known.
+func maxRSS(state *os.ProcessState) int64 {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	return int64(usage.Maxrss) * 1024
+}
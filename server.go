@@ -1,21 +1,153 @@
 package shellspy
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+const (
+	// DefaultAuthTimeout is the [Server.AuthTimeout] set by [NewServer].
+	DefaultAuthTimeout = 30 * time.Second
+	// DefaultMaxUnauthenticated is the [Server.MaxUnauthenticated] set
+	// by [NewServer].
+	DefaultMaxUnauthenticated = 64
+	// DefaultSessionQueueTimeout is the [Server.SessionQueueTimeout] set
+	// by [NewServer].
+	DefaultSessionQueueTimeout = time.Minute
+)
+
+// ShutdownTimeout is how long [ServerInstance] waits for sessions to
+// finish after receiving SIGINT or SIGTERM before forcibly closing them.
+var ShutdownTimeout = 30 * time.Second
+
 type Server struct {
-	Address             string
-	Password            string
-	Logger              io.Writer
+	Address  string
+	Password string
+	// PasswordHash is a bcrypt hash of the password. When set it is
+	// used instead of the plaintext Password.
+	PasswordHash string
+	Logger       io.Writer
+	// TranscriptDirectory is where session transcripts are written, one
+	// file per session named after its [NewSessionID].
 	TranscriptDirectory string
-	TranscriptCounter   atomic.Uint64
+	// TranscriptTemplate, if set, names transcripts relative to
+	// TranscriptDirectory instead, e.g. "{date}/{user}/{id}.log". See
+	// [ExpandTranscriptTemplate] for the fields available.
+	TranscriptTemplate string
+	// TranscriptFormat selects how transcripts are written. The default
+	// is [TranscriptText].
+	TranscriptFormat TranscriptFormat
+	// StderrColor colors command output on stderr red for clients
+	// whose terminals support ANSI escape sequences.
+	StderrColor bool
+	// Env is the environment, as NAME=value strings, that sessions
+	// start with. When nil it is the environment of the server process
+	// without PASSWORD and PASSWORD_HASH. See [LoadEnvFile].
+	Env []string
+	// TLSConfig optionally configures TLS for [Server.ServeTLS] and
+	// [Server.ListenAndServeTLS]. It is cloned before use.
+	TLSConfig *tls.Config
+	// Users maps usernames to bcrypt password hashes. When it is not
+	// empty operators log in with a username and their own password
+	// instead of the shared Password. See [LoadUsersFile].
+	Users map[string]string
+	// Authenticator performs the challenge in [Server.Auth]. When nil a
+	// [UsersAuthenticator] is used if Users is set, and otherwise a
+	// [PasswordAuthenticator] for Password and PasswordHash.
+	Authenticator Authenticator
+	// Limiter, if set, slows down and bans clients that repeatedly
+	// fail the Authenticator challenge.
+	Limiter *LoginLimiter
+	// AuthTimeout limits how long a client may take to complete the TLS
+	// handshake and login challenge. Zero means no limit.
+	AuthTimeout time.Duration
+	// MaxUnauthenticated caps the number of connections that may be
+	// waiting to log in at once. Zero means no limit.
+	MaxUnauthenticated int
+	// IdleTimeout ends sessions that receive no input for this long.
+	// Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxSessionDuration ends sessions that last this long, regardless
+	// of activity. Zero means no limit.
+	MaxSessionDuration time.Duration
+	// ExpiryWarning is how long before either limit users are warned.
+	ExpiryWarning time.Duration
+	// AuthMode selects whether operators authenticate with the
+	// Authenticator, a verified TLS client certificate, or both.
+	AuthMode AuthMode
+	// MaxConnections and MaxConnectionsPerIP cap the number of open
+	// connections in total and from a single remote IP. Connections over
+	// either cap are told the server is busy and closed. Zero means no
+	// limit.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// MaxSessions and MaxSessionsPerIP cap the number of logged in
+	// sessions in total and from a single remote IP. Zero means no limit.
+	MaxSessions      int
+	MaxSessionsPerIP int
+	// SessionQueueSize is how many logged in users may wait for a free
+	// session when MaxSessions or MaxSessionsPerIP is reached, for at
+	// most SessionQueueTimeout each. Zero rejects them straight away.
+	SessionQueueSize    int
+	SessionQueueTimeout time.Duration
+
+	mu              sync.Mutex
+	capacity        capacity
+	listeners       map[*net.Listener]struct{}
+	conns           map[net.Conn]struct{}
+	inShutdown      atomic.Bool
+	unauthenticated atomic.Int64
+	ctx             context.Context
+	cancel          context.CancelFunc
+}
+
+// AuthMode describes the credentials a [Server] requires before
+// starting a session.
+type AuthMode int
+
+const (
+	// AuthPassword challenges via [Server.Authenticator] only.
+	AuthPassword AuthMode = iota
+	// AuthClientCert requires a TLS client certificate verified against
+	// [Server.TLSConfig] ClientCAs and skips the password challenge.
+	AuthClientCert
+	// AuthClientCertAndPassword requires both a verified TLS client
+	// certificate and the [Server.Authenticator] challenge.
+	AuthClientCertAndPassword
+)
+
+// ParseAuthMode converts one of "password", "cert" or "cert+password"
+// into an [AuthMode].
+func ParseAuthMode(s string) (AuthMode, error) {
+	switch s {
+	case "password":
+		return AuthPassword, nil
+	case "cert":
+		return AuthClientCert, nil
+	case "cert+password":
+		return AuthClientCertAndPassword, nil
+	}
+	return AuthPassword, fmt.Errorf("unknown auth mode %q", s)
+}
+
+func (m AuthMode) requiresClientCert() bool {
+	return m == AuthClientCert || m == AuthClientCertAndPassword
+}
+
+func (m AuthMode) requiresPassword() bool {
+	return m == AuthPassword || m == AuthClientCertAndPassword
 }
 
 // NewServer is a convenience wrapper for the [Server] struct with sensible defaults.
@@ -25,12 +157,15 @@ func NewServer(addr, password, transcriptDirectory string) *Server {
 		Password:            password,
 		Address:             addr,
 		TranscriptDirectory: transcriptDirectory,
-		TranscriptCounter:   atomic.Uint64{},
+		AuthTimeout:         DefaultAuthTimeout,
+		MaxUnauthenticated:  DefaultMaxUnauthenticated,
+		ExpiryWarning:       DefaultExpiryWarning,
+		SessionQueueTimeout: DefaultSessionQueueTimeout,
 	}
 }
 
-// ListenAndServe listens on the provided address and starts a goroutine
-// for to support multiple simultaneous connections.
+// ListenAndServe listens on the TCP address [Server.Address] and
+// then calls [Server.Serve] to handle incoming connections.
 func (s *Server) ListenAndServe() error {
 	s.Logf("Starting listener on %s\n", s.Address)
 	listener, err := net.Listen("tcp", s.Address)
@@ -39,53 +174,355 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 	s.Log("Listener created.")
-	defer listener.Close()
+	return s.Serve(listener)
+}
+
+// Serve accepts incoming connections on the listener l, starting a
+// goroutine for each to support multiple simultaneous connections.
+// Serve always closes l before returning, and returns [ErrServerClosed]
+// once the server has been shut down.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(&l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+	defer l.Close()
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			s.Log(err)
 			return fmt.Errorf("connection error: %w", err)
 		}
 		s.Logf("Accepting connection from %s\n", conn.RemoteAddr())
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			continue
+		}
 		go s.handle(conn)
 	}
 }
 
-// Auth is a method on server that takes a [net.conn],
-// challenges the user for the [server] password, returning true
-// if the password matches and false if it does not.
-func (s *Server) Auth(conn io.ReadWriter) bool {
-	fmt.Fprintln(conn, "Enter Password: ")
-	scan := bufio.NewScanner(conn)
-	if !scan.Scan() {
-		s.Log(scan.Err())
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections and then waits for every active session to finish. If ctx
+// expires first, the remaining sessions are cancelled, their connections
+// closed and their transcripts flushed before Shutdown returns ctx.Err().
+// Once Shutdown has been called, [Server.Serve] and
+// [Server.ListenAndServe] return [ErrServerClosed].
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.activeConns() > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			s.waitForConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Close immediately closes all listeners and active connections,
+// cancelling any commands that are still running. For a graceful
+// alternative see [Server.Shutdown].
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	s.closeConns()
+	return err
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// sessionContext returns the parent context for sessions started by the server.
+// It is cancelled when the server forcibly closes its connections.
+func (s *Server) sessionContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.shuttingDown() {
 		return false
 	}
-	if scan.Text() == s.Password {
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if !add {
+		delete(s.conns, conn)
 		return true
 	}
-	fmt.Fprintln(conn, "Incorrect Password: Closing connection")
-	return false
+	if s.shuttingDown() {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) activeConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// waitForConns blocks until every connection handler has returned,
+// which guarantees their transcripts have been closed.
+func (s *Server) waitForConns() {
+	for s.activeConns() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Auth is a method on server that takes a [net.conn],
+// challenges the user via the [Server.Authenticator], returning true
+// if the challenge succeeds and false if it does not.
+func (s *Server) Auth(conn io.ReadWriter) bool {
+	_, err := s.authenticator().Authenticate(conn, nil)
+	if errors.Is(err, ErrAuthFailed) {
+		fmt.Fprintln(conn, "Incorrect Password: Closing connection")
+	} else if err != nil {
+		s.Log(err)
+	}
+	return err == nil
+}
+
+func (s *Server) authenticator() Authenticator {
+	if s.Authenticator != nil {
+		return s.Authenticator
+	}
+	if len(s.Users) > 0 {
+		return UsersAuthenticator{Users: s.Users}
+	}
+	return PasswordAuthenticator{Password: s.Password, Hash: s.PasswordHash}
 }
 
 // handle is a method on server that takes a [net.Conn],
 // Provides an [Auth] challenge, and initiates a [session] on
 // successful login. Will not create a [session] on failed [Auth] challenge.
 func (s *Server) handle(conn net.Conn) {
+	defer s.trackConn(conn, false)
 	defer conn.Close()
-	if !s.Auth(conn) {
-		s.Logf("FAILED LOGIN from %s\n", conn.RemoteAddr())
+	ip := remoteIP(conn.RemoteAddr())
+	// The deadline also covers the TLS handshake, which starts with the
+	// first write, so it is set before any rejection is sent.
+	var deadline time.Time
+	if s.AuthTimeout > 0 {
+		deadline = time.Now().Add(s.AuthTimeout)
+		conn.SetDeadline(deadline)
+	}
+	if reason, ok := s.acquireConn(ip); !ok {
+		fmt.Fprintln(conn, "Server busy: too many connections, try again later")
+		s.Logf("CONNECTION REJECTED from %s: server busy (%s)\n", conn.RemoteAddr(), reason)
+		return
+	}
+	defer s.releaseConn(ip)
+	pending := s.unauthenticated.Add(1)
+	if s.MaxUnauthenticated > 0 && pending > int64(s.MaxUnauthenticated) {
+		s.unauthenticated.Add(-1)
+		fmt.Fprintln(conn, "Too many pending logins: Closing connection")
+		s.Logf("LOGIN REJECTED from %s: too many unauthenticated connections\n", conn.RemoteAddr())
+		return
+	}
+	identity, user, ok := s.login(conn, deadline)
+	s.unauthenticated.Add(-1)
+	if !ok {
 		return
 	}
-	s.Logf("SUCCESSFUL LOGIN from %s\n", conn.RemoteAddr())
+	conn.SetDeadline(time.Time{})
+	if !s.acquireSession(conn, ip) {
+		return
+	}
+	defer s.releaseSession(ip)
+	id := NewSessionID()
+	if identity != "" {
+		s.Logf("SUCCESSFUL LOGIN from %s as %s session %s\n", conn.RemoteAddr(), identity, id)
+	} else {
+		s.Logf("SUCCESSFUL LOGIN from %s session %s\n", conn.RemoteAddr(), id)
+	}
 	fmt.Fprintln(conn, "Welcome to the remote shell!")
-	transcriptLogName := fmt.Sprint(s.TranscriptCounter.Add(1))
-	pathname := fmt.Sprintf("%s/transcript-%s.txt", s.TranscriptDirectory, transcriptLogName)
-	session := NewSpySession(WithConnection(conn), WithTranscriptPath(pathname), WithServerLogger(s.Logger))
+	fmt.Fprintf(conn, "Session ID: %s\n", id)
+	pathname, err := s.transcriptPath(id, user, ip)
+	if err != nil {
+		s.Log(err)
+	}
+	session := NewSpySession(
+		WithConnection(conn),
+		WithTranscriptPath(pathname),
+		WithTranscriptFormat(s.TranscriptFormat),
+		WithSessionID(id),
+		WithStderrColor(s.StderrColor),
+		WithEnv(s.sessionEnv()),
+		WithServerLogger(s.Logger),
+		WithContext(s.sessionContext()),
+		WithIdentity(identity),
+		WithIdleTimeout(s.IdleTimeout),
+		WithMaxDuration(s.MaxSessionDuration),
+		WithExpiryWarning(s.ExpiryWarning),
+	)
 	session.Start()
 	fmt.Fprintln(conn, "Goodbye!")
 }
 
+// login runs the TLS handshake, client certificate check and
+// [Server.Authenticator] challenge required by [Server.AuthMode],
+// logging the outcome of any failure. It returns a description of the
+// authenticated identity and the username, if there is one. Any delay
+// for a failed login ends by deadline, unless that is zero.
+func (s *Server) login(conn net.Conn, deadline time.Time) (identity, user string, ok bool) {
+	ip := remoteIP(conn.RemoteAddr())
+	if s.Limiter != nil {
+		if until, banned := s.Limiter.Banned(ip, ""); banned {
+			fmt.Fprintln(conn, "Too many failed logins: Closing connection")
+			s.Logf("LOGIN BLOCKED from %s: banned until %s\n", conn.RemoteAddr(), until.Format(time.RFC3339))
+			return "", "", false
+		}
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if isTimeout(err) {
+			s.Logf("LOGIN TIMEOUT from %s during TLS handshake after %s\n", conn.RemoteAddr(), s.AuthTimeout)
+			return "", "", false
+		}
+		if err != nil {
+			s.Logf("TLS handshake failed from %s: %s\n", conn.RemoteAddr(), err)
+			return "", "", false
+		}
+		identity = clientCertIdentity(tlsConn.ConnectionState())
+	}
+	if s.AuthMode.requiresClientCert() && identity == "" {
+		fmt.Fprintln(conn, "Client certificate required: Closing connection")
+		s.Logf("FAILED LOGIN from %s: no verified client certificate\n", conn.RemoteAddr())
+		return "", "", false
+	}
+	if !s.AuthMode.requiresPassword() {
+		return identity, "", true
+	}
+	id, err := s.authenticator().Authenticate(conn, conn.RemoteAddr())
+	if isTimeout(err) {
+		s.Logf("LOGIN TIMEOUT from %s after %s\n", conn.RemoteAddr(), s.AuthTimeout)
+		return "", "", false
+	}
+	// A banned username is only known once the credentials have been
+	// read, so it is turned away exactly as a wrong password would be,
+	// without revealing whether the password was right.
+	if s.Limiter != nil && id.Username != "" && (err == nil || errors.Is(err, ErrAuthFailed)) {
+		if until, banned := s.Limiter.Banned("", id.Username); banned {
+			s.Logf("LOGIN BLOCKED from %s for user %q: banned until %s\n", conn.RemoteAddr(), id.Username, until.Format(time.RFC3339))
+			s.rejectLogin(conn, id.Username, deadline)
+			return "", "", false
+		}
+	}
+	if err != nil {
+		s.logFailedLogin(conn.RemoteAddr(), id, err)
+		if errors.Is(err, ErrAuthFailed) {
+			s.rejectLogin(conn, id.Username, deadline)
+		}
+		return "", "", false
+	}
+	if s.Limiter != nil {
+		s.Limiter.Success(ip, id.Username)
+	}
+	if id.Username != "" {
+		identity = strings.TrimSpace("user=" + id.Username + " " + identity)
+	}
+	return identity, id.Username, true
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// rejectLogin records a failed login for username with the
+// [Server.Limiter] and tells the user. The delay the limiter asks for
+// comes first, as a client could hang up rather than wait after the
+// reply, and ends by deadline so that the connection does not hold on
+// to its unauthenticated slot any longer than a pending login may.
+func (s *Server) rejectLogin(conn net.Conn, username string, deadline time.Time) {
+	if s.Limiter != nil {
+		d := s.Limiter.Failure(remoteIP(conn.RemoteAddr()), username)
+		if !deadline.IsZero() && time.Until(deadline) < d {
+			d = time.Until(deadline)
+		}
+		s.pause(d)
+	}
+	fmt.Fprintln(conn, "Incorrect Password: Closing connection")
+}
+
+// pause waits for d, returning early if the server is closed.
+func (s *Server) pause(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.sessionContext().Done():
+	}
+}
+
+func (s *Server) logFailedLogin(addr net.Addr, id Identity, err error) {
+	msg := fmt.Sprintf("FAILED LOGIN from %s", addr)
+	if id.Username != "" {
+		msg += fmt.Sprintf(" for user %q", id.Username)
+	}
+	if !errors.Is(err, ErrAuthFailed) {
+		msg += fmt.Sprintf(": %s", err)
+	}
+	s.Log(msg)
+}
+
 // Log writes args to the [Server.Logger].
 func (s *Server) Log(args ...any) {
 	fmt.Fprintln(s.Logger, args...)
@@ -103,6 +540,8 @@ func ListenAndServe(addr, serverPassword, logDir string) error {
 	return s.ListenAndServe()
 }
 
+// ErrServerClosed is returned by [Server.Serve] and [Server.ListenAndServe]
+// after a call to [Server.Shutdown] or [Server.Close].
 var ErrServerClosed = errors.New("Server closed")
 
 func ServerInstance() int {
@@ -111,11 +550,48 @@ func ServerInstance() int {
 		fmt.Fprintln(os.Stderr, "PORT environment variable must be set")
 		return 1
 	}
+	AUTH_MODE := AuthPassword
+	if mode := os.Getenv("AUTH_MODE"); mode != "" {
+		var err error
+		AUTH_MODE, err = ParseAuthMode(mode)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
 	PASSWORD := os.Getenv("PASSWORD")
-	if PASSWORD == "" {
-		fmt.Fprintln(os.Stderr, "PASSWORD environment variable must be set")
+	PASSWORD_HASH := os.Getenv("PASSWORD_HASH")
+	USERS_FILE := os.Getenv("USERS_FILE")
+	AUTH_COMMAND := os.Getenv("AUTH_COMMAND")
+	if PASSWORD == "" && PASSWORD_HASH == "" && USERS_FILE == "" && AUTH_COMMAND == "" && AUTH_MODE.requiresPassword() {
+		fmt.Fprintln(os.Stderr, "PASSWORD, PASSWORD_HASH, USERS_FILE or AUTH_COMMAND environment variable must be set")
 		return 1
 	}
+	var AUTHENTICATOR Authenticator
+	if AUTH_COMMAND != "" {
+		timeout, err := durationFromEnv("AUTH_COMMAND_TIMEOUT", DefaultAuthCommandTimeout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		AUTHENTICATOR = CommandAuthenticator{Path: AUTH_COMMAND, Timeout: timeout}
+	}
+	var USERS map[string]string
+	if USERS_FILE != "" {
+		var err error
+		USERS, err = LoadUsersFile(USERS_FILE)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if PASSWORD_HASH != "" {
+		err := validatePasswordHash(PASSWORD_HASH)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "PASSWORD_HASH is not a valid bcrypt hash:", err)
+			return 1
+		}
+	}
 	LOG_DIR := os.Getenv("LOG_DIR")
 	if LOG_DIR == "" {
 		cwd, err := os.Getwd()
@@ -131,14 +607,181 @@ func ServerInstance() int {
 		fmt.Fprintln(os.Stderr, err)
 		return 1
 	}
+	TRANSCRIPT_TEMPLATE := os.Getenv("TRANSCRIPT_TEMPLATE")
+	if TRANSCRIPT_TEMPLATE != "" {
+		err := ValidateTranscriptTemplate(TRANSCRIPT_TEMPLATE)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	TRANSCRIPT_FORMAT := TranscriptText
+	if format := os.Getenv("TRANSCRIPT_FORMAT"); format != "" {
+		TRANSCRIPT_FORMAT, err = ParseTranscriptFormat(format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	var SESSION_ENV []string
+	if path := os.Getenv("SESSION_ENV_FILE"); path != "" {
+		SESSION_ENV, err = LoadEnvFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	TLS_CERT, TLS_KEY, err := tlsFilesFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	AUTH_TIMEOUT, err := durationFromEnv("AUTH_TIMEOUT", DefaultAuthTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	IDLE_TIMEOUT, err := durationFromEnv("IDLE_TIMEOUT", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	MAX_SESSION_DURATION, err := durationFromEnv("MAX_SESSION_DURATION", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	MAX_UNAUTHENTICATED, err := intFromEnv("MAX_UNAUTHENTICATED", DefaultMaxUnauthenticated)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	MAX_CONNECTIONS, err := intFromEnv("MAX_CONNECTIONS", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	MAX_CONNECTIONS_PER_IP, err := intFromEnv("MAX_CONNECTIONS_PER_IP", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	MAX_SESSIONS, err := intFromEnv("MAX_SESSIONS", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	MAX_SESSIONS_PER_IP, err := intFromEnv("MAX_SESSIONS_PER_IP", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	SESSION_QUEUE_SIZE, err := intFromEnv("SESSION_QUEUE_SIZE", 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	SESSION_QUEUE_TIMEOUT, err := durationFromEnv("SESSION_QUEUE_TIMEOUT", DefaultSessionQueueTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	LIMITER, err := loginLimiterFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	TLS_CONFIG, err := clientCertConfigFromEnv(AUTH_MODE)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if AUTH_MODE.requiresClientCert() && TLS_CERT == "" {
+		fmt.Fprintln(os.Stderr, "TLS_CERT and TLS_KEY environment variables must be set to use client certificates")
+		return 1
+	}
 	fmt.Println("Starting shellspy on port", PORT)
-	if err := ListenAndServe(fmt.Sprintf("0.0.0.0:%s", PORT), PASSWORD, LOG_DIR); err != nil && err != ErrServerClosed {
+	s := NewServer(fmt.Sprintf("0.0.0.0:%s", PORT), PASSWORD, LOG_DIR)
+	s.PasswordHash = PASSWORD_HASH
+	s.Users = USERS
+	s.Authenticator = AUTHENTICATOR
+	s.Limiter = LIMITER
+	s.AuthTimeout = AUTH_TIMEOUT
+	s.MaxUnauthenticated = MAX_UNAUTHENTICATED
+	s.IdleTimeout = IDLE_TIMEOUT
+	s.MaxSessionDuration = MAX_SESSION_DURATION
+	s.TranscriptTemplate = TRANSCRIPT_TEMPLATE
+	s.TranscriptFormat = TRANSCRIPT_FORMAT
+	s.StderrColor = os.Getenv("STDERR_COLOR") == "true"
+	s.Env = SESSION_ENV
+	s.MaxConnections = MAX_CONNECTIONS
+	s.MaxConnectionsPerIP = MAX_CONNECTIONS_PER_IP
+	s.MaxSessions = MAX_SESSIONS
+	s.MaxSessionsPerIP = MAX_SESSIONS_PER_IP
+	s.SessionQueueSize = SESSION_QUEUE_SIZE
+	s.SessionQueueTimeout = SESSION_QUEUE_TIMEOUT
+	s.AuthMode = AUTH_MODE
+	if PASSWORD_HASH == "" && PASSWORD != "" && USERS == nil && AUTHENTICATOR == nil {
+		s.Log("WARNING PASSWORD is stored in plaintext, use PASSWORD_HASH from `shellspysrv hash-password` instead")
+	}
+	s.TLSConfig = TLS_CONFIG
+	serve := s.ListenAndServe
+	if TLS_CERT != "" {
+		serve = func() error {
+			return s.ListenAndServeTLS(TLS_CERT, TLS_KEY)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		stop()
+		s.Log("Shutting down, waiting for active sessions to finish")
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			s.Log("Forced shutdown:", err)
+		}
+	}()
+	if err := serve(); err != ErrServerClosed {
 		fmt.Fprint(os.Stderr, err)
 		return 1
 	}
+	<-shutdown
+	s.Log("Server closed")
 	return 0
 }
 
+// durationFromEnv parses the environment variable key as a
+// [time.Duration], returning def if it is not set.
+func durationFromEnv(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s environment variable must be a duration like 30s: %w", key, err)
+	}
+	return d, nil
+}
+
+// intFromEnv parses the environment variable key as a non-negative
+// integer, returning def if it is not set.
+func intFromEnv(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s environment variable must be a non-negative number", key)
+	}
+	return n, nil
+}
+
 func createDirectoryIfNotExists(path string) error {
 	dir, err := os.Stat(path)
 	if err != nil {
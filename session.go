@@ -2,46 +2,93 @@ package shellspy
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"bitbucket.org/creachadair/shell"
+	"golang.org/x/term"
 )
 
+// DefaultExpiryWarning is how long before a session expires the user
+// is warned, unless changed with [WithExpiryWarning].
+const DefaultExpiryWarning = time.Minute
+
 // CommandFromString takes a string and converts it into a
-// pointer to a [exec.Cmd] struct. It will return an error if
-// there are unbalanced quotes or backslashes in the string.
+// pointer to a [exec.Cmd] struct, quoting and escaping as a session
+// does. It will return an error if there are unbalanced quotes or
+// backslashes in the string, or if it is a list, pipeline or has
+// redirections, which only a session can run.
 func CommandFromString(s string) (*exec.Cmd, error) {
-	commands, ok := shell.Split(s)
-	if !ok {
-		return nil, fmt.Errorf("unbalanced quotes or backslashes in [%s]", s)
+	stages, err := parsePipeline(s)
+	if err != nil {
+		return nil, err
 	}
-	if len(commands) == 0 {
+	if len(stages) == 0 {
 		return nil, nil
 	}
-	path := commands[0]
-	args := commands[1:]
-	return exec.Command(path, args...), nil
+	if len(stages) > 1 || len(stages[0].redirects) > 0 {
+		return nil, fmt.Errorf("pipelines and redirections are not supported in [%s]", s)
+	}
+	args := stages[0].args
+	return exec.Command(args[0], args[1:]...), nil
+}
+
+// NewSessionID returns a new identifier for a session, made of the
+// current UTC time and a random suffix so that identifiers sort by
+// start time and never repeat, even across restarts.
+func NewSessionID() string {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		panic(err)
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
 }
 
 type session struct {
 	input          io.Reader
 	terminal       io.Writer
 	transcript     io.Writer
-	combinedOutput io.Writer
+	format         TranscriptFormat
+	recorder       recorder
+	mu             *sync.Mutex
 	transcriptPath string
 	serverLogger   io.Writer
+	ctx            context.Context
+	sessionID      string
+	remoteAddr     string
+	identity       string
+	cwd            string
+	oldDir         string
+	dirStack       []string
+	env            map[string]string
+	lastExitCode   int
+	stderrColor    bool
+	stats          sessionStats
+	idleTimeout    time.Duration
+	maxDuration    time.Duration
+	expiryWarning  time.Duration
 }
 
 // Convenience wrapped around Session with default arguments.
 func NewSpySession(opts ...SessionOption) *session {
 	s := &session{
-		input:        os.Stdin,
-		terminal:     os.Stdout,
-		serverLogger: os.Stdout,
+		input:         os.Stdin,
+		terminal:      os.Stdout,
+		serverLogger:  os.Stdout,
+		ctx:           context.Background(),
+		expiryWarning: DefaultExpiryWarning,
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -82,6 +129,75 @@ func WithConnection(conn net.Conn) SessionOption {
 	return func(s *session) *session {
 		s.input = conn
 		s.terminal = conn
+		s.remoteAddr = conn.RemoteAddr().String()
+		return s
+	}
+}
+
+// WithTranscriptFormat selects how the transcript is written. The
+// default is [TranscriptText]. [TranscriptJSONL] writes one JSON object
+// per line with a "time" and a "type" of:
+//
+//   - "start", with the "session_id", "identity" and "remote_addr"
+//   - "input", with each line read as "data"
+//   - "output", with a chunk of output as "data" and its "stream",
+//     one of "stdout", "stderr" or "shell" for messages from shellspy
+//   - "env", with the "name" and new "value" of a variable set by the
+//     export builtin, or just the "name" of one removed by unset
+//   - "exit", with the "command", the "cwd" it ran in, its "exit_code",
+//     "duration", "user_time" and "sys_time" in seconds, "max_rss" in
+//     bytes, and any "error" running it. "argv" lists the arguments of
+//     each stage of the pipeline after expanding variables and glob
+//     patterns, and "pipe_status" the exit code of each stage when
+//     there is more than one.
+//   - "end", with the "reason" the session ended
+//
+// [TranscriptAsciicast] writes an asciicast v2 recording.
+// [TranscriptScript] writes a typescript, and when the transcript is
+// written to a path, a timing file alongside it ending ".timing".
+func WithTranscriptFormat(format TranscriptFormat) SessionOption {
+	return func(s *session) *session {
+		s.format = format
+		return s
+	}
+}
+
+// WithWorkingDirectory sets the directory commands start in. It
+// defaults to the working directory of the process, and changes with
+// the cd, pushd and popd builtins.
+func WithWorkingDirectory(dir string) SessionOption {
+	return func(s *session) *session {
+		s.cwd = dir
+		return s
+	}
+}
+
+// WithEnv sets the environment, as NAME=value strings, that the
+// session starts with. It defaults to the environment of the process,
+// and changes with the export and unset builtins.
+func WithEnv(env []string) SessionOption {
+	return func(s *session) *session {
+		s.env = envMap(env)
+		return s
+	}
+}
+
+// WithStderrColor colors output that commands write to stderr red on
+// the terminal. It should only be enabled if the terminal supports ANSI
+// escape sequences. The transcript is not affected.
+func WithStderrColor(enabled bool) SessionOption {
+	return func(s *session) *session {
+		s.stderrColor = enabled
+		return s
+	}
+}
+
+// WithSessionID records the session identifier at the start of the
+// transcript. Sessions with an identifier log a summary of the commands
+// they ran to the server logger when they end.
+func WithSessionID(id string) SessionOption {
+	return func(s *session) *session {
+		s.sessionID = id
 		return s
 	}
 }
@@ -93,8 +209,53 @@ func WithServerLogger(serverLogger io.Writer) SessionOption {
 	}
 }
 
-func (s session) printPromptToCombinedOutput() {
-	fmt.Fprint(s.combinedOutput, "$ ")
+// WithContext ties the session to ctx. Once ctx is cancelled any
+// running command is killed and no further input is processed.
+func WithContext(ctx context.Context) SessionOption {
+	return func(s *session) *session {
+		s.ctx = ctx
+		return s
+	}
+}
+
+// WithIdentity records who the session belongs to. A non-empty
+// identity is written as a header at the top of the transcript.
+func WithIdentity(identity string) SessionOption {
+	return func(s *session) *session {
+		s.identity = identity
+		return s
+	}
+}
+
+// WithIdleTimeout ends the session if no input is received for d.
+func WithIdleTimeout(d time.Duration) SessionOption {
+	return func(s *session) *session {
+		s.idleTimeout = d
+		return s
+	}
+}
+
+// WithMaxDuration ends the session, killing any running command,
+// once it has lasted for d regardless of activity.
+func WithMaxDuration(d time.Duration) SessionOption {
+	return func(s *session) *session {
+		s.maxDuration = d
+		return s
+	}
+}
+
+// WithExpiryWarning sets how long before an idle timeout or the
+// maximum duration the user is warned that the session will end.
+func WithExpiryWarning(d time.Duration) SessionOption {
+	return func(s *session) *session {
+		s.expiryWarning = d
+		return s
+	}
+}
+
+func (s *session) printPromptToCombinedOutput() {
+	fmt.Fprint(s.terminal, "$ ")
+	s.record(event{Type: eventPrompt, Data: "$ "})
 }
 
 func (s session) printMessageToUser(msg string) {
@@ -105,66 +266,571 @@ func (s session) log(args ...any) {
 	fmt.Fprintln(s.serverLogger, args...)
 }
 
+// record passes e to the transcript recorder, timestamping it if
+// necessary.
+func (s *session) record(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder.record(e)
+}
+
+// output returns a writer that sends everything written to it to the
+// terminal and records it in the transcript as part of stream. A
+// command's stdout and stderr are copied from separate pipes, so writes
+// to each stay in order, but those close together on different streams
+// may be swapped.
+func (s *session) output(stream string) io.Writer {
+	w := streamWriter{mu: s.mu, terminal: s.terminal, recorder: s.recorder, stream: stream}
+	if stream == streamStderr && s.stderrColor {
+		w.color = colorRed
+	}
+	return w
+}
+
 // Start reads from the [session] input
 // and write to the [session] output. It will also
-// write to the [session] transcript.
+// write to the [session] transcript. A transcript path that
+// already exists is never overwritten.
 func (s session) Start() {
+	s.stats = sessionStats{start: time.Now(), bytesIn: &atomic.Int64{}, bytesOut: &atomic.Int64{}}
+	s.input = countingReader{r: s.input, n: s.stats.bytesIn}
+	if s.cwd == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			s.log(err)
+		}
+		s.cwd = cwd
+	}
+	if s.env == nil {
+		s.env = envMap(os.Environ())
+	}
+	s.terminal = countingWriter{w: s.terminal, n: s.stats.bytesOut}
+	created := false
 	if s.transcript == nil {
 		s.transcript = io.Discard
 		if s.transcriptPath == "" {
 			s.printMessageToUser("No transcript requested")
 		} else {
-			transcript, err := os.Create(s.transcriptPath)
+			transcript, err := os.OpenFile(s.transcriptPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
 			if err != nil {
 				s.printMessageToUser("WARNING No transcript will be available for this session!")
 				s.log(err)
 			} else {
+				defer transcript.Close()
 				s.transcript = transcript
+				created = true
 				s.log("Transcript for new session available at", s.transcriptPath)
 			}
 		}
 	}
-	s.combinedOutput = io.MultiWriter(s.terminal, s.transcript)
+	timing := io.Discard
+	if created && s.format == TranscriptScript {
+		f := s.createCompanionFile("Timing", companionPath(s.transcriptPath, s.format, ".timing"))
+		if f != nil {
+			defer f.Close()
+			timing = f
+		}
+	}
+	var metadata *os.File
+	if created {
+		metadata = s.createCompanionFile("Metadata", companionPath(s.transcriptPath, s.format, ".meta.json"))
+		if metadata != nil {
+			defer metadata.Close()
+			s.writeMetadata(metadata, "")
+		}
+	}
+	s.mu = &sync.Mutex{}
+	s.recorder = newRecorder(s.format, s.transcript, timing)
+	s.record(event{Type: eventStart, SessionID: s.sessionID, Identity: s.identity, RemoteAddr: s.remoteAddr})
+	reason := s.loop()
+	s.record(event{Type: eventEnd, Reason: reason})
+	if metadata != nil {
+		s.writeMetadata(metadata, reason)
+	}
+	if s.sessionID != "" {
+		s.log(fmt.Sprintf("SESSION END %s after %s (%s): %s", s.sessionID, time.Since(s.stats.start).Round(time.Millisecond), reason, s.stats))
+	}
+}
+
+// companionPath returns the path of a file such as the timing or
+// [SessionMetadata] that accompanies the transcript at path, written in
+// format. Only the extension of the format is replaced by suffix, as a
+// templated name such as "127.0.0.1" may have none.
+func companionPath(path string, format TranscriptFormat, suffix string) string {
+	return strings.TrimSuffix(path, format.Extension()) + suffix
+}
+
+// createCompanionFile creates a file to accompany the transcript, such
+// as its timing or metadata, warning the user if that is not possible.
+func (s *session) createCompanionFile(kind, path string) *os.File {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		s.printMessageToUser(fmt.Sprintf("WARNING No %s will be available for this session!", strings.ToLower(kind)))
+		s.log(err)
+		return nil
+	}
+	s.log(kind, "for new session available at", path)
+	return f
+}
+
+func (s *session) writeMetadata(f *os.File, reason string) {
+	err := writeMetadata(f, s.metadata(reason))
+	if err != nil {
+		s.log(err)
+	}
+}
+
+// loop runs commands until the session ends, returning why it ended.
+func (s *session) loop() string {
+	parent := s.ctx
+	// Cancelling the context when the loop returns also stops readLines
+	// if it is waiting to hand over a line that will never be processed.
+	var cancel context.CancelFunc
+	if s.maxDuration > 0 {
+		s.ctx, cancel = context.WithTimeout(s.ctx, s.maxDuration)
+	} else {
+		s.ctx, cancel = context.WithCancel(s.ctx)
+	}
+	defer cancel()
 	s.printPromptToCombinedOutput()
-	scan := bufio.NewScanner(s.input)
-	for scan.Scan() {
-		line := scan.Text()
-		err := s.processLine(line)
-		if err == io.EOF {
-			break
+	lines, scanErr := s.readLines(s.ctx)
+	t := newSessionTimers(s.idleTimeout, s.maxDuration, s.expiryWarning)
+	for {
+		if s.ctx.Err() != nil {
+			if parent.Err() != nil {
+				return "server closed"
+			}
+			return s.expire(fmt.Sprintf("maximum session length of %s reached", s.maxDuration))
+		}
+		timer := time.NewTimer(t.next())
+		select {
+		case line, ok := <-lines:
+			timer.Stop()
+			if !ok {
+				if err := <-scanErr; err != nil && s.ctx.Err() == nil {
+					s.log(err)
+				}
+				return "input closed"
+			}
+			err := s.processLine(line)
+			if err == io.EOF {
+				return "exit"
+			}
+			t.activity()
+		case <-timer.C:
+			warning, reason := t.fire()
+			if warning != "" {
+				s.printMessageToUser("\n" + warning)
+				fmt.Fprint(s.terminal, "$ ")
+			}
+			if reason != "" {
+				return s.expire(reason)
+			}
+		case <-s.ctx.Done():
+			timer.Stop()
 		}
 	}
-	if scan.Err() != nil {
-		s.log(scan.Err())
+}
+
+// readLines scans the session input in the background so that Start
+// can wait for the next line and its timers at the same time. The lines
+// channel is closed when the input is exhausted or ctx is done, after
+// which the scan error, if any, is available on the second channel.
+func (s session) readLines(ctx context.Context) (<-chan string, <-chan error) {
+	lines := make(chan string)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scan := bufio.NewScanner(s.input)
+		for scan.Scan() {
+			select {
+			case lines <- scan.Text():
+			case <-ctx.Done():
+				scanErr <- nil
+				return
+			}
+		}
+		scanErr <- scan.Err()
+	}()
+	return lines, scanErr
+}
+
+// expire tells both the user and the transcript why the session is
+// ending, and returns the reason for the end of session event.
+func (s *session) expire(reason string) string {
+	fmt.Fprintf(s.output(streamShell), "\nSession expired: %s\n", reason)
+	if s.transcriptPath != "" {
+		s.log(fmt.Sprintf("Session expired: %s (transcript %s)", reason, s.transcriptPath))
+	} else {
+		s.log("Session expired:", reason)
 	}
+	return "expired: " + reason
 }
 
+// processLine runs the pipelines listed on line, skipping those after
+// "&&" if the last one failed or after "||" if it succeeded, and
+// records each separately.
 func (s *session) processLine(line string) error {
-	fmt.Fprintf(s.transcript, "%s\n", line)
-	if line == "exit" {
-		return io.EOF
-	}
-	cmd, err := CommandFromString(line)
+	s.record(event{Type: eventInput, Data: line})
+	items, err := parseList(line)
 	if err != nil {
-		fmt.Fprintln(s.combinedOutput, err)
+		s.fail(line, err)
 		s.printPromptToCombinedOutput()
 		return nil
 	}
-	if cmd == nil {
+	if items == nil {
 		return nil
 	}
-	cmd.Stdout = s.combinedOutput
-	cmd.Stderr = s.combinedOutput
-	err = cmd.Run()
-	if err != nil {
-		fmt.Fprintln(s.combinedOutput, err)
+	for _, item := range items {
+		if item.op == "&&" && s.lastExitCode != 0 || item.op == "||" && s.lastExitCode == 0 {
+			continue
+		}
+		if item.text == "exit" {
+			return io.EOF
+		}
+		s.runPipeline(item.text)
 	}
 	s.printPromptToCombinedOutput()
 	return nil
 }
 
+// runPipeline expands the variables and glob patterns in text and runs
+// the pipeline.
+func (s *session) runPipeline(text string) {
+	var stages []stage
+	expanded, err := expandEnv(text, s.lookupEnv)
+	if err == nil {
+		stages, err = parsePipeline(expanded)
+	}
+	if err != nil {
+		s.fail(text, err)
+		return
+	}
+	for i := range stages {
+		stages[i] = s.expandGlobs(stages[i])
+	}
+	exit := s.execute(text, stages)
+	s.record(exit)
+	s.stats.add(exit)
+	s.lastExitCode = *exit.ExitCode
+}
+
+// fail reports a command that could not be parsed.
+func (s *session) fail(command string, err error) {
+	fmt.Fprintln(s.terminal, err)
+	exit := event{Type: eventExit, Command: command, Error: err.Error()}
+	s.record(exit)
+	s.stats.add(exit)
+	s.lastExitCode = 2
+}
+
+// stageRun is a [stage] of a pipeline being run.
+type stageRun struct {
+	stage   stage
+	builtin builtin
+	cmd     *exec.Cmd
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	// files are the ends of pipes and redirected files to close once
+	// the stage has started.
+	files   []*os.File
+	started bool
+	code    int
+	err     error
+}
+
+// execute runs the stages of a pipeline in the session working
+// directory and environment, connected by pipes, returning the resulting
+// exit event. Builtins run in the session itself, and as they never read
+// their input, anything piped to them is discarded.
+func (s *session) execute(line string, stages []stage) event {
+	exit := event{Type: eventExit, Command: line, Cwd: s.cwd}
+	start := time.Now()
+	runs := make([]*stageRun, len(stages))
+	for i, st := range stages {
+		exit.Argv = append(exit.Argv, st.args)
+		r := &stageRun{stage: st}
+		r.builtin, _ = s.builtin(st.args)
+		runs[i] = r
+	}
+	for i, r := range runs {
+		r.stderr = s.output(streamStderr)
+		switch {
+		case i == len(runs)-1:
+			r.stdout = s.output(streamStdout)
+		case runs[i+1].builtin != nil:
+			r.stdout = io.Discard
+		default:
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				r.err = err
+				continue
+			}
+			r.stdout = pw
+			r.files = append(r.files, pw)
+			runs[i+1].stdin = pr
+			runs[i+1].files = append(runs[i+1].files, pr)
+		}
+		r.err = s.redirect(r)
+	}
+	for _, r := range runs {
+		if r.builtin == nil && r.err == nil {
+			r.cmd, r.err = s.command(r.stage.args)
+		}
+		if r.cmd != nil {
+			r.cmd.Stdin, r.cmd.Stdout, r.cmd.Stderr = r.stdin, r.stdout, r.stderr
+			r.err = r.cmd.Start()
+			r.started = r.err == nil
+		}
+		if r.builtin == nil {
+			r.closeFiles()
+		}
+	}
+	for _, r := range runs {
+		if r.builtin != nil && r.err == nil {
+			r.err = r.builtin(s, r.stage.args[1:], r.stdout)
+			r.started = true
+		}
+		r.closeFiles()
+	}
+	s.wait(runs)
+	var errs []string
+	for i, r := range runs {
+		last := i == len(runs)-1
+		switch {
+		case r.cmd != nil && r.cmd.ProcessState != nil:
+			r.code = exitCode(r.cmd.ProcessState)
+			exit.UserTime += r.cmd.ProcessState.UserTime().Seconds()
+			exit.SysTime += r.cmd.ProcessState.SystemTime().Seconds()
+			if rss := maxRSS(r.cmd.ProcessState); rss > exit.MaxRSS {
+				exit.MaxRSS = rss
+			}
+		case r.started:
+			if r.err != nil {
+				r.code = 1
+			}
+		case errors.Is(r.err, exec.ErrNotFound):
+			// Like sh, 127 means the command was not found.
+			r.code = 127
+		default:
+			r.code = 1
+		}
+		if len(runs) > 1 {
+			exit.PipeStatus = append(exit.PipeStatus, r.code)
+		}
+		// Only the last stage decides whether the pipeline failed, but
+		// any stage that could not be started is reported.
+		if r.err != nil && (last || !r.started) {
+			errs = append(errs, r.err.Error())
+		}
+		if last {
+			code := r.code
+			exit.ExitCode = &code
+		}
+	}
+	exit.Duration = time.Since(start).Seconds()
+	if len(errs) > 0 {
+		exit.Error = strings.Join(errs, "\n")
+		fmt.Fprintln(s.terminal, exit.Error)
+	}
+	return exit
+}
+
+// redirect applies the redirections of a stage in order, opening the
+// files they name.
+func (s *session) redirect(r *stageRun) error {
+	for _, rd := range r.stage.redirects {
+		var f *os.File
+		var err error
+		switch rd.op {
+		case "2>&1":
+			r.stderr = r.stdout
+			continue
+		case "<":
+			f, err = os.Open(s.path(rd.file))
+		default:
+			f, err = s.create(rd.file, strings.HasSuffix(rd.op, ">>"))
+		}
+		if err != nil {
+			return err
+		}
+		r.files = append(r.files, f)
+		switch rd.op {
+		case "<":
+			r.stdin = f
+		case ">", ">>":
+			r.stdout = f
+		case "2>", "2>>":
+			r.stderr = f
+		}
+	}
+	return nil
+}
+
+// closeFiles closes the parent's copies of the files a stage uses.
+func (r *stageRun) closeFiles() {
+	for _, f := range r.files {
+		f.Close()
+	}
+	r.files = nil
+}
+
+// path resolves name relative to the session working directory.
+func (s *session) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(s.cwd, name)
+}
+
+// create opens name for writing as the target of a redirection.
+func (s *session) create(name string, append bool) (*os.File, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if append {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	return os.OpenFile(s.path(name), flag, 0o666)
+}
+
+// wait waits for the commands started for runs to complete, killing
+// them if the session context is cancelled in the meantime.
+func (s *session) wait(runs []*stageRun) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			for _, r := range runs {
+				if r.cmd != nil && r.started {
+					r.cmd.Process.Kill()
+				}
+			}
+		case <-done:
+		}
+	}()
+	for _, r := range runs {
+		if r.cmd != nil && r.started {
+			r.err = r.cmd.Wait()
+		}
+	}
+}
+
 func LocalInstance() int {
-	session := NewSpySession(WithTranscriptPath("transcript.txt"))
+	// Sessions never overwrite an existing transcript, but locally the
+	// previous transcript.txt is always replaced.
+	os.Remove("transcript.txt")
+	os.Remove(companionPath("transcript.txt", TranscriptText, ".meta.json"))
+	session := NewSpySession(
+		WithTranscriptPath("transcript.txt"),
+		WithStderrColor(term.IsTerminal(int(os.Stdout.Fd()))),
+	)
 	session.Start()
 	return 0
 }
+
+// sessionTimers tracks when an idle timeout or maximum session length
+// is due, and when the user should be warned about each.
+type sessionTimers struct {
+	idleTimeout time.Duration
+	maxDuration time.Duration
+	warning     time.Duration
+	idleAt      time.Time
+	maxAt       time.Time
+	idleWarned  bool
+	maxWarned   bool
+}
+
+func newSessionTimers(idleTimeout, maxDuration, warning time.Duration) *sessionTimers {
+	now := time.Now()
+	t := &sessionTimers{idleTimeout: idleTimeout, maxDuration: maxDuration, warning: warning}
+	if maxDuration > 0 {
+		t.maxAt = now.Add(maxDuration)
+	}
+	t.activity()
+	return t
+}
+
+// activity restarts the idle timeout.
+func (t *sessionTimers) activity() {
+	if t.idleTimeout > 0 {
+		t.idleAt = time.Now().Add(t.idleTimeout)
+		t.idleWarned = false
+	}
+}
+
+// next returns how long until the next warning or expiry is due.
+func (t *sessionTimers) next() time.Duration {
+	next := time.Duration(1<<63 - 1)
+	for _, due := range t.due() {
+		if d := time.Until(due); d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+func (t *sessionTimers) due() []time.Time {
+	var due []time.Time
+	if !t.idleAt.IsZero() {
+		if !t.idleWarned && t.warning > 0 && t.warning < t.idleTimeout {
+			due = append(due, t.idleAt.Add(-t.warning))
+		}
+		due = append(due, t.idleAt)
+	}
+	if !t.maxAt.IsZero() && !t.maxWarned && t.warning > 0 && t.warning < t.maxDuration {
+		due = append(due, t.maxAt.Add(-t.warning))
+	}
+	return due
+}
+
+// fire returns any warning that is now due and, if the idle timeout
+// has passed, the reason the session should end. The maximum duration
+// itself is enforced by the session context.
+func (t *sessionTimers) fire() (warning, reason string) {
+	now := time.Now()
+	if !t.idleAt.IsZero() && !now.Before(t.idleAt) {
+		return "", fmt.Sprintf("idle for %s", t.idleTimeout)
+	}
+	if !t.maxAt.IsZero() && !t.maxWarned && t.warning > 0 && t.warning < t.maxDuration && !now.Before(t.maxAt.Add(-t.warning)) {
+		t.maxWarned = true
+		return fmt.Sprintf("WARNING this session will end in %s as it reaches the maximum session length", t.warning), ""
+	}
+	if !t.idleAt.IsZero() && !t.idleWarned && t.warning > 0 && t.warning < t.idleTimeout && !now.Before(t.idleAt.Add(-t.warning)) {
+		t.idleWarned = true
+		return fmt.Sprintf("WARNING this session will end in %s if no input is received", t.warning), ""
+	}
+	return "", ""
+}
+
+// sessionStats totals the resources used by the commands in a session.
+type sessionStats struct {
+	start    time.Time
+	commands int
+	failed   int
+	userTime float64
+	sysTime  float64
+	maxRSS   int64
+	bytesIn  *atomic.Int64
+	bytesOut *atomic.Int64
+}
+
+func (st *sessionStats) add(exit event) {
+	st.commands++
+	if exit.Error != "" {
+		st.failed++
+	}
+	st.userTime += exit.UserTime
+	st.sysTime += exit.SysTime
+	if exit.MaxRSS > st.maxRSS {
+		st.maxRSS = exit.MaxRSS
+	}
+}
+
+func (st sessionStats) String() string {
+	return fmt.Sprintf("commands=%d failed=%d user=%s sys=%s maxrss=%dKiB",
+		st.commands, st.failed, seconds(st.userTime), seconds(st.sysTime), st.maxRSS/1024)
+}
@@ -3,13 +3,21 @@ package shellspy_test
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"testing/iotest"
@@ -23,8 +31,9 @@ import (
 
 func TestMain(m *testing.M) {
 	os.Exit(testscript.RunMain(m, map[string]func() int{
-		"local":  shellspy.LocalInstance,
-		"server": shellspy.ServerInstance,
+		"local":         shellspy.LocalInstance,
+		"server":        shellspy.ServerInstance,
+		"hash-password": shellspy.HashPasswordInstance,
 	}))
 }
 
@@ -82,6 +91,16 @@ func TestCommandFromString_WithEmptyStringReturnsNeitherCmdNorError(t *testing.T
 	}
 }
 
+func TestCommandFromString_RejectsPipelinesAndRedirections(t *testing.T) {
+	t.Parallel()
+	for _, input := range []string{"ls | wc -l", "ls > files", "ls; pwd", "echo 'unbalanced"} {
+		_, err := shellspy.CommandFromString(input)
+		if err == nil {
+			t.Errorf("wanted error for %q", input)
+		}
+	}
+}
+
 func TestSpySession_ReadsUserInputToCompletion(t *testing.T) {
 	t.Parallel()
 	input := strings.NewReader("test input one\ntest input two\ntest input three\n")
@@ -98,7 +117,7 @@ func TestSpySession_ReadsUserInputToCompletion(t *testing.T) {
 func TestSpySession_ExecutesCommandsAndOutputsResults(t *testing.T) {
 	t.Parallel()
 	input := strings.NewReader("echo one\necho two\necho three\n")
-	buf := &bytes.Buffer{}
+	buf := &syncBuffer{}
 	shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(buf)).Start()
 	want := "$ one\n$ two\n$ three\n$ "
 	got := buf.String()
@@ -110,7 +129,7 @@ func TestSpySession_ExecutesCommandsAndOutputsResults(t *testing.T) {
 func TestSpySession_PrintsErrorsForFailedCommands(t *testing.T) {
 	t.Parallel()
 	input := strings.NewReader("nonexistent command\n")
-	buf := &bytes.Buffer{}
+	buf := &syncBuffer{}
 	shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(buf)).Start()
 	want := "$ exec: \"nonexistent\": executable file not found in $PATH\n$ "
 	got := buf.String()
@@ -121,7 +140,7 @@ func TestSpySession_PrintsErrorsForFailedCommands(t *testing.T) {
 
 func TestSpySession_PrintsErrorsForInvalidCommands(t *testing.T) {
 	input := strings.NewReader("'''\n\n")
-	buf := &bytes.Buffer{}
+	buf := &syncBuffer{}
 	shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(buf)).Start()
 	want := "$ unbalanced quotes or backslashes in [''']\n$ "
 	got := buf.String()
@@ -130,10 +149,58 @@ func TestSpySession_PrintsErrorsForInvalidCommands(t *testing.T) {
 	}
 }
 
+func TestSpySession_RefusesToOverwriteExistingTranscript(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/transcript.txt"
+	err := os.WriteFile(path, []byte("earlier session\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(strings.NewReader("echo hello\n")),
+		shellspy.WithOutput(buf),
+		shellspy.WithServerLogger(io.Discard),
+		shellspy.WithTranscriptPath(path),
+	).Start()
+	if !strings.Contains(buf.String(), "WARNING No transcript will be available for this session!") {
+		t.Fatalf("wanted transcript warning, got %q", buf.String())
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "earlier session\n"
+	got := string(contents)
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestNewSessionID_IsUniqueAndSortsByStartTime(t *testing.T) {
+	t.Parallel()
+	seen := map[string]bool{}
+	prev := ""
+	for i := 0; i < 1000; i++ {
+		id := shellspy.NewSessionID()
+		if !sessionIDs.MatchString(id) {
+			t.Fatalf("unexpected session ID format %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate session ID %q", id)
+		}
+		seen[id] = true
+		if id[:16] < prev {
+			t.Fatalf("session ID %q sorts before earlier timestamp %q", id, prev)
+		}
+		prev = id[:16]
+	}
+}
+
 func TestSpySession_ProducesTranscriptOfSession(t *testing.T) {
 	t.Parallel()
 	input := strings.NewReader("echo one\necho two\necho three\n")
-	buf := &bytes.Buffer{}
+	buf := &syncBuffer{}
 	session := shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(&bytes.Buffer{}), shellspy.WithTranscript(buf))
 	session.Start()
 	want := `$ echo one
@@ -143,103 +210,1658 @@ two
 $ echo three
 three
 $ `
-	got := buf.String()
+	got := withoutAnnotations(buf.String())
 	if want != got {
 		t.Fatal(cmp.Diff(want, got))
 	}
 }
-func TestSpySession_TerminatesOnExitCommand(t *testing.T) {
+
+func TestSpySession_WritesMetadataSidecar(t *testing.T) {
 	t.Parallel()
-	s := setupRemoteServer(t, "password", io.Discard)
-	conn := setupConnection(t, s.Address)
-	supplyPassword(t, conn, "password")
-	time.Sleep(100 * time.Millisecond)
-	writeLine(t, conn, "exit")
-	err := waitForBrokenPipe(conn)
-	if !errors.Is(err, syscall.EPIPE) {
-		t.Fatalf("expected broken pipe, but got %v", err)
+	dir := t.TempDir()
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(strings.NewReader("echo hello\nexit\n")),
+		shellspy.WithOutput(&bytes.Buffer{}),
+		shellspy.WithServerLogger(io.Discard),
+		shellspy.WithTranscriptPath(dir+"/session.txt"),
+		shellspy.WithSessionID("1"),
+		shellspy.WithIdentity("user=alice"),
+	)
+	session.Start()
+	data, err := os.ReadFile(dir + "/session.meta.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got shellspy.SessionMetadata
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := shellspy.SessionMetadata{
+		SessionID:  "1",
+		Identity:   "user=alice",
+		Hostname:   hostname,
+		Version:    shellspy.Version,
+		Transcript: "session.txt",
+		Format:     "text",
+		Reason:     "exit",
+		Commands:   1,
+		BytesIn:    int64(len("echo hello\nexit\n")),
+		BytesOut:   int64(len("$ hello\n$ ")),
+	}
+	if !cmp.Equal(want, got, cmpopts.IgnoreFields(shellspy.SessionMetadata{}, "Start", "End")) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	if got.End == nil || got.End.Before(got.Start) {
+		t.Fatalf("wanted end time after start time %s, got %v", got.Start, got.End)
 	}
 }
 
-func TestRemoteShell_DisplaysTerminalPrompt(t *testing.T) {
+func TestSpySession_NamesCompanionFilesAfterTranscript(t *testing.T) {
 	t.Parallel()
-	input := strings.NewReader("exit\n")
-	buf := &bytes.Buffer{}
-	shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(buf), shellspy.WithTranscript(io.Discard)).Start()
-	want := "$ "
-	got := buf.String()
+	cases := map[string]struct {
+		name   string
+		format shellspy.TranscriptFormat
+		want   []string
+	}{
+		"replaces the extension of the format": {
+			name:   "session.typescript",
+			format: shellspy.TranscriptScript,
+			want:   []string{"session.meta.json", "session.timing", "session.typescript"},
+		},
+		"keeps dots in a name without extension": {
+			name:   "127.0.0.1",
+			format: shellspy.TranscriptScript,
+			want:   []string{"127.0.0.1", "127.0.0.1.meta.json", "127.0.0.1.timing"},
+		},
+		"keeps an extension of another format": {
+			name:   "session.log",
+			format: shellspy.TranscriptText,
+			want:   []string{"session.log", "session.log.meta.json"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			shellspy.NewSpySession(
+				shellspy.WithInput(strings.NewReader("exit\n")),
+				shellspy.WithOutput(&bytes.Buffer{}),
+				shellspy.WithServerLogger(io.Discard),
+				shellspy.WithTranscriptPath(dir+"/"+tc.name),
+				shellspy.WithTranscriptFormat(tc.format),
+			).Start()
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if !cmp.Equal(tc.want, got) {
+				t.Fatal(cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
+
+func TestSpySession_CdChangesWorkingDirectoryForLaterCommands(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	err := os.MkdirAll(dir+"/sub", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(dir+"/sub/marker", nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.NewReader("cd sub\npwd\nls\ncd ..\npwd\ncd -\ncd nonexistent\npwd\n")
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(buf),
+		shellspy.WithWorkingDirectory(dir),
+	).Start()
+	want := strings.Join([]string{
+		"$ $ " + dir + "/sub",
+		"$ marker",
+		"$ $ " + dir,
+		"$ " + dir + "/sub",
+		"$ cd: " + dir + "/sub/nonexistent: no such file or directory",
+		"$ " + dir + "/sub",
+		"$ ",
+	}, "\n")
+	got := output.String()
 	if want != got {
-		t.Fatalf(cmp.Diff(want, got))
+		t.Fatal(cmp.Diff(want, got))
+	}
+	wantAnnotation := "# exit=1 time="
+	if !strings.Contains(buf.String(), wantAnnotation) || !strings.Contains(buf.String(), "cwd="+dir+"/sub\n") {
+		t.Fatalf("wanted transcript annotations with exit status and cwd, got %q", buf.String())
 	}
 }
 
-func TestRemoteShell_AuthClosesSessionOnWrongPassword(t *testing.T) {
+func TestSpySession_PushdAndPopdManageDirectoryStack(t *testing.T) {
 	t.Parallel()
-	s := setupRemoteServer(t, "correctPassword", io.Discard)
-	conn := setupConnection(t, s.Address)
-	line := readLine(t, conn)
-	if line != "Enter Password: " {
-		t.Fatalf("wanted 'Enter Password: ', got %s", line)
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b"} {
+		err := os.Mkdir(dir+"/"+sub, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
-	writeLine(t, conn, "wrongPassword")
-	line = readLine(t, conn)
-	if line != "Incorrect Password: Closing connection" {
-		t.Fatalf("wanted 'Incorrect Password: Closing connection', got %s", line)
+	input := strings.NewReader("pushd a\npushd ../b\npushd\npopd\npopd\npopd\n")
+	output := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithWorkingDirectory(dir),
+	).Start()
+	a, b := dir+"/a", dir+"/b"
+	want := strings.Join([]string{
+		"$ " + a + " " + dir,
+		"$ " + b + " " + a + " " + dir,
+		"$ " + a + " " + b + " " + dir,
+		"$ " + b + " " + dir,
+		"$ " + dir,
+		"$ popd: directory stack empty",
+		"$ ",
+	}, "\n")
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
 	}
-	err := waitForBrokenPipe(conn)
-	if !errors.Is(err, syscall.EPIPE) {
-		t.Fatalf("expected error, but got %q", err)
+}
+
+func TestSpySession_TagsStderrInTranscriptKeepingEachStreamInOrder(t *testing.T) {
+	t.Parallel()
+	command := "sh -c 'for i in 1 2 3 4 5 6 7 8; do echo out$i; echo err$i >&2; done'"
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	session := shellspy.NewSpySession(shellspy.WithInput(strings.NewReader(command+"\n")), shellspy.WithOutput(output), shellspy.WithTranscript(buf))
+	session.Start()
+	// The streams reach the session through separate pipes, so only the
+	// order within each of them is certain.
+	var wantOut, wantErr []string
+	for i := 1; i <= 8; i++ {
+		wantOut = append(wantOut, fmt.Sprintf("out%d", i))
+		wantErr = append(wantErr, fmt.Sprintf("err%d", i))
+	}
+	lines := strings.Split(withoutAnnotations(buf.String()), "\n")
+	if lines[0] != "$ "+command || lines[len(lines)-1] != "$ " {
+		t.Fatalf("wanted transcript to record the command and next prompt, got %q", buf.String())
+	}
+	var gotOut, gotErr []string
+	for _, line := range lines[1 : len(lines)-1] {
+		if strings.HasPrefix(line, "[stderr] ") {
+			gotErr = append(gotErr, strings.TrimPrefix(line, "[stderr] "))
+		} else {
+			gotOut = append(gotOut, line)
+		}
+	}
+	if !cmp.Equal(wantOut, gotOut) {
+		t.Error(cmp.Diff(wantOut, gotOut))
+	}
+	if !cmp.Equal(wantErr, gotErr) {
+		t.Error(cmp.Diff(wantErr, gotErr))
+	}
+	var terminalOut, terminalErr []string
+	for _, line := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(output.String(), "$ "), "\n$ "), "\n") {
+		if strings.HasPrefix(line, "err") {
+			terminalErr = append(terminalErr, line)
+		} else {
+			terminalOut = append(terminalOut, line)
+		}
+	}
+	if !cmp.Equal(wantOut, terminalOut) {
+		t.Error(cmp.Diff(wantOut, terminalOut))
+	}
+	if !cmp.Equal(wantErr, terminalErr) {
+		t.Error(cmp.Diff(wantErr, terminalErr))
 	}
 }
-func TestRemoteShell_AuthKeepsSessionAliveOnCorrectPassword(t *testing.T) {
+
+func TestSpySession_DoesNotLeakInputReaderAfterExit(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		shellspy.NewSpySession(
+			shellspy.WithInput(strings.NewReader("exit\nls\n")),
+			shellspy.WithOutput(io.Discard),
+			shellspy.WithTranscript(io.Discard),
+		).Start()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted input readers to stop after exit, %d goroutines before and %d after", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSpySession_ExpandsVariablesOutsideSingleQuotes(t *testing.T) {
 	t.Parallel()
-	s := setupRemoteServer(t, "correctPassword", io.Discard)
-	conn := setupConnection(t, s.Address)
-	line := readLine(t, conn)
-	if line != "Enter Password: " {
-		t.Fatalf("wanted 'Enter Password: ', got %s", line)
+	input := strings.NewReader(strings.Join([]string{
+		"echo $GREETING",
+		"echo '$GREETING'",
+		`echo "${GREETING}!"`,
+		`echo \$GREETING "\$GREETING"`,
+		"echo $QUOTE $UNSET.",
+		"false",
+		"echo $?",
+		"echo ${GREETING",
+		"echo $?",
+	}, "\n"))
+	output := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithEnv([]string{"PATH=" + os.Getenv("PATH"), "GREETING=hello  world", `QUOTE=it's "quoted"`}),
+	).Start()
+	want := strings.Join([]string{
+		"$ hello world",
+		"$ $GREETING",
+		"$ hello  world!",
+		"$ $GREETING $GREETING",
+		`$ it's "quoted" .`,
+		"$ exit status 1",
+		"$ 1",
+		"$ bad substitution in [${GREETING]",
+		"$ 2",
+		"$ ",
+	}, "\n")
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
 	}
-	writeLine(t, conn, "correctPassword")
-	line = readLine(t, conn)
-	if line != "Welcome to the remote shell!" {
-		t.Fatalf("wanted 'Welcome to the remote shell!', got %s", line)
+}
+
+func TestSpySession_ExportAndUnsetChangeEnvironmentOfLaterCommands(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	input := strings.NewReader(strings.Join([]string{
+		"export GREETING=hello",
+		"sh -c 'echo $GREETING'",
+		"env",
+		"unset GREETING",
+		"sh -c 'echo ${GREETING-unset}'",
+		"export 1X=y",
+	}, "\n"))
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(buf),
+		shellspy.WithWorkingDirectory(dir),
+		shellspy.WithEnv([]string{"PATH=" + os.Getenv("PATH")}),
+	).Start()
+	want := strings.Join([]string{
+		"$ $ hello",
+		"$ GREETING=hello",
+		"PATH=" + os.Getenv("PATH"),
+		"PWD=" + dir,
+		"$ $ unset",
+		"$ export: 1X=y: not a valid identifier",
+		"$ ",
+	}, "\n")
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
 	}
-	err := waitForBrokenPipe(conn)
+	for _, note := range []string{"export GREETING=hello\n# env GREETING=hello\n", "unset GREETING\n# env unset GREETING\n"} {
+		if !strings.Contains(buf.String(), note) {
+			t.Errorf("wanted transcript to contain %q, got %q", note, buf.String())
+		}
+	}
+}
+
+func TestSpySession_LooksUpCommandsInSessionPath(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/greet", []byte("#!/bin/sh\necho hello from greet\n"), 0o755)
 	if err != nil {
-		t.Fatalf("expected no error, but got %q", err)
+		t.Fatal(err)
+	}
+	input := strings.NewReader("greet\nls\n")
+	output := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithEnv([]string{"PATH=" + dir}),
+	).Start()
+	want := "$ hello from greet\n$ exec: \"ls\": executable file not found in $PATH\n$ "
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
 	}
 }
 
-func TestAuthIsFalseForErrorOnRead(t *testing.T) {
+func TestSpySession_RunsPipelinesAndRedirections(t *testing.T) {
 	t.Parallel()
-	conn := ErrConn{iotest.ErrReader(errors.New("faulty read"))}
-	s := setupRemoteServer(t, "correctPassword", io.Discard)
-	if s.Auth(conn) {
-		t.Fatal(true)
+	dir := t.TempDir()
+	input := strings.NewReader(strings.Join([]string{
+		`printf 'b\na\nc\n' | sort | head -2`,
+		"echo hello > out.txt",
+		"echo again >>out.txt",
+		"cat < out.txt",
+		"sh -c 'echo oops >&2' 2>&1 | tr a-z A-Z",
+		"sh -c 'echo hidden >&2' 2> err.txt",
+		`echo 'a|b' "c > d" e\<f`,
+		"pwd | cat",
+		"false | true",
+		"ls |",
+		"cat < missing.txt; echo $?",
+		"nonexistent; echo $?",
+	}, "\n"))
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(buf),
+		shellspy.WithWorkingDirectory(dir),
+	).Start()
+	want := strings.Join([]string{
+		"$ a",
+		"b",
+		"$ $ $ hello",
+		"again",
+		"$ OOPS",
+		"$ $ a|b c > d e<f",
+		"$ " + dir,
+		"$ $ syntax error near newline in [ls |]",
+		"$ open " + dir + "/missing.txt: no such file or directory",
+		"1",
+		`$ exec: "nonexistent": executable file not found in $PATH`,
+		"127",
+		"$ ",
+	}, "\n")
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	data, err := os.ReadFile(dir + "/err.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hidden\n" {
+		t.Fatalf("wanted stderr redirected to err.txt, got %q", data)
+	}
+	for _, wantAnnotation := range []string{
+		"false | true\n# exit=0 pipestatus=1,0 time=",
+		"missing.txt: no such file or directory\n# exit=1 time=",
+	} {
+		if !strings.Contains(buf.String(), wantAnnotation) {
+			t.Errorf("wanted transcript to contain %q, got %q", wantAnnotation, buf.String())
+		}
 	}
 }
-func TestAuthIsFalseForIncorrectPassword(t *testing.T) {
+
+func TestSpySession_AppliesRedirectionsInOrder(t *testing.T) {
 	t.Parallel()
-	conn := &bytes.Buffer{}
-	fmt.Fprintln(conn, "incorrectPassword")
-	s := setupRemoteServer(t, "correctPassword", io.Discard)
-	if s.Auth(conn) {
-		t.Fatal(true)
+	dir := t.TempDir()
+	input := strings.NewReader(strings.Join([]string{
+		"sh -c 'echo out; echo err >&2' > both.txt 2>&1",
+		"sh -c 'echo out; echo err >&2' 2>&1 > only.txt",
+	}, "\n"))
+	output := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithWorkingDirectory(dir),
+	).Start()
+	want := "$ $ err\n$ "
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	for name, want := range map[string]string{"both.txt": "out\nerr\n", "only.txt": "out\n"} {
+		data, err := os.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("wanted %s to contain %q, got %q", name, want, data)
+		}
+	}
+}
+
+func TestSpySession_ChainsCommandsWithShortCircuiting(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader(strings.Join([]string{
+		"echo one; echo two;",
+		"false && echo skipped || echo recovered",
+		"true || echo skipped && echo ran",
+		"export X=1 && echo $X",
+		"false; echo $?",
+		`echo 'a;b' a\&\&b`,
+		"&& echo x",
+		"echo x ||",
+		"echo last; exit",
+		"echo never",
+	}, "\n"))
+	output := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+	).Start()
+	want := strings.Join([]string{
+		"$ one",
+		"two",
+		"$ exit status 1",
+		"recovered",
+		"$ ran",
+		"$ 1",
+		"$ exit status 1",
+		"1",
+		"$ a;b a&&b",
+		`$ syntax error near "&&" in [&& echo x]`,
+		"$ syntax error near newline in [echo x ||]",
+		"$ last",
+		"",
+	}, "\n")
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestSpySession_RecordsEachChainedCommandSeparately(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(strings.NewReader("false || echo ok && echo yes; echo done\n")),
+		shellspy.WithOutput(io.Discard),
+		shellspy.WithTranscript(buf),
+		shellspy.WithTranscriptFormat(shellspy.TranscriptJSONL),
+	).Start()
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e struct{ Type, Command string }
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type == "exit" {
+			got = append(got, e.Command)
+		}
+	}
+	want := []string{"false", "echo ok", "echo yes", "echo done"}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestSpySession_ExpandsUnquotedGlobPatterns(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log", "c.txt", ".hidden.log", "sub/d.log", "sub/deeper/e.log", "*.log"} {
+		err := os.MkdirAll(filepath.Dir(dir+"/"+name), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(dir+"/"+name, nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := strings.NewReader(strings.Join([]string{
+		"echo *.log",
+		"echo ?.txt [ab].log",
+		"echo **/*.log",
+		"echo '*.log' \\*.log \"s*\"",
+		"echo *.nothing",
+		"echo " + dir + "/sub/*.log",
+	}, "\n"))
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(buf),
+		shellspy.WithTranscriptFormat(shellspy.TranscriptJSONL),
+		shellspy.WithWorkingDirectory(dir),
+	).Start()
+	want := strings.Join([]string{
+		"$ *.log a.log b.log",
+		"$ c.txt a.log b.log",
+		"$ *.log a.log b.log sub/d.log sub/deeper/e.log",
+		"$ *.log *.log s*",
+		"$ *.nothing",
+		"$ " + dir + "/sub/d.log",
+		"$ ",
+	}, "\n")
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	wantArgv := `"argv":[["echo","*.log","a.log","b.log"]]`
+	if !strings.Contains(buf.String(), wantArgv) {
+		t.Fatalf("wanted transcript to contain %s, got %q", wantArgv, buf.String())
+	}
+}
+
+func TestSpySession_ColorsStderrRedOnTerminalWhenEnabled(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("sh -c 'echo err >&2'\n")
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(buf),
+		shellspy.WithStderrColor(true),
+	)
+	session.Start()
+	want := "$ \x1b[31merr\n\x1b[0m$ "
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	if strings.Contains(buf.String(), "\x1b") {
+		t.Fatalf("wanted transcript without color, got %q", buf.String())
+	}
+}
+
+func TestSpySession_AnnotatesTranscriptWithExitStatusAndResourceUsage(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("sh -c 'printf partial; exit 3'\n")
+	buf := &syncBuffer{}
+	session := shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(&bytes.Buffer{}), shellspy.WithTranscript(buf))
+	session.Start()
+	want := regexp.MustCompile(`^\$ sh -c 'printf partial; exit 3'\npartial\nexit status 3\n# exit=3 time=\S+ user=\S+ sys=\S+ maxrss=\d+KiB cwd=\S+\n\$ $`)
+	got := buf.String()
+	if !want.MatchString(got) {
+		t.Fatalf("wanted transcript to match %s, got %q", want, got)
+	}
+}
+
+func TestSpySession_RecordsSignalledCommandsAsExitStatus128PlusSignal(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("sh -c 'kill -9 $$'; echo $?\nyes | head -1\n")
+	output := &syncBuffer{}
+	buf := &syncBuffer{}
+	session := shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(output), shellspy.WithTranscript(buf))
+	session.Start()
+	want := "$ signal: killed\n137\n$ y\n$ "
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	for _, wantAnnotation := range []string{"# exit=137 time=", "# exit=0 pipestatus=141,0 time="} {
+		if !strings.Contains(buf.String(), wantAnnotation) {
+			t.Errorf("wanted transcript to contain %q, got %q", wantAnnotation, buf.String())
+		}
+	}
+}
+
+func TestSpySession_LogsResourceSummaryAtEnd(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("echo hello\nsh -c 'exit 1'\nexit\n")
+	logger := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(&bytes.Buffer{}),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithServerLogger(logger),
+		shellspy.WithSessionID("1"),
+	)
+	session.Start()
+	want := regexp.MustCompile(`SESSION END 1 after \S+ \(exit\): commands=2 failed=1 user=\S+ sys=\S+ maxrss=\d+KiB\n`)
+	got := logger.String()
+	if !want.MatchString(got) {
+		t.Fatalf("wanted server log to match %s, got %q", want, got)
+	}
+}
+func TestSpySession_WritesJSONLTranscriptOfSession(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("echo hello\nsh -c 'echo oops >&2; exit 3'\nexit\n")
+	buf := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(&bytes.Buffer{}),
+		shellspy.WithTranscript(buf),
+		shellspy.WithTranscriptFormat(shellspy.TranscriptJSONL),
+		shellspy.WithServerLogger(io.Discard),
+		shellspy.WithSessionID("1"),
+		shellspy.WithIdentity("user=alice"),
+		shellspy.WithWorkingDirectory("/"),
+	)
+	session.Start()
+	var got []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]any
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("invalid JSON event %q: %v", line, err)
+		}
+		_, err = time.Parse(time.RFC3339Nano, e["time"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, measured := range []string{"time", "duration", "user_time", "sys_time", "max_rss"} {
+			delete(e, measured)
+		}
+		got = append(got, e)
+	}
+	want := []map[string]any{
+		{"type": "start", "session_id": "1", "identity": "user=alice"},
+		{"type": "input", "data": "echo hello"},
+		{"type": "output", "stream": "stdout", "data": "hello\n"},
+		{"type": "exit", "command": "echo hello", "argv": []any{[]any{"echo", "hello"}}, "cwd": "/", "exit_code": 0.0},
+		{"type": "input", "data": "sh -c 'echo oops >&2; exit 3'"},
+		{"type": "output", "stream": "stderr", "data": "oops\n"},
+		{"type": "exit", "command": "sh -c 'echo oops >&2; exit 3'", "argv": []any{[]any{"sh", "-c", "echo oops >&2; exit 3"}}, "cwd": "/", "exit_code": 3.0, "error": "exit status 3"},
+		{"type": "input", "data": "exit"},
+		{"type": "end", "reason": "exit"},
+	}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestSpySession_WritesAsciicastRecordingOfSession(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("echo hello\nexit\n")
+	buf := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(input),
+		shellspy.WithOutput(&bytes.Buffer{}),
+		shellspy.WithTranscript(buf),
+		shellspy.WithTranscriptFormat(shellspy.TranscriptAsciicast),
+	)
+	session.Start()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var header struct {
+		Version   int   `json:"version"`
+		Width     int   `json:"width"`
+		Height    int   `json:"height"`
+		Timestamp int64 `json:"timestamp"`
+	}
+	err := json.Unmarshal([]byte(lines[0]), &header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width == 0 || header.Height == 0 || header.Timestamp == 0 {
+		t.Fatalf("invalid asciicast header %s", lines[0])
+	}
+	var got [][]string
+	last := 0.0
+	for _, line := range lines[1:] {
+		var e []any
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("invalid asciicast event %q: %v", line, err)
+		}
+		if e[0].(float64) < last {
+			t.Fatalf("event %s is earlier than the one before", line)
+		}
+		last = e[0].(float64)
+		got = append(got, []string{e[1].(string), e[2].(string)})
+	}
+	want := [][]string{
+		{"o", "$ "},
+		{"i", "echo hello\n"},
+		{"o", "echo hello\r\n"},
+		{"o", "hello\r\n"},
+		{"o", "$ "},
+		{"i", "exit\n"},
+		{"o", "exit\r\n"},
+	}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestSpySession_WritesTypescriptAndTimingFileForScriptreplay(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(strings.NewReader("echo hello\nexit\n")),
+		shellspy.WithOutput(&bytes.Buffer{}),
+		shellspy.WithServerLogger(io.Discard),
+		shellspy.WithTranscriptPath(dir+"/session.typescript"),
+		shellspy.WithTranscriptFormat(shellspy.TranscriptScript),
+	)
+	session.Start()
+	typescript, err := os.ReadFile(dir + "/session.typescript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(typescript), "\n")
+	if !strings.HasPrefix(lines[0], "Script started on ") {
+		t.Fatalf("wanted typescript to start with 'Script started on', got %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[len(lines)-2], "Script done on ") {
+		t.Fatalf("wanted typescript to end with 'Script done on', got %q", lines[len(lines)-2])
+	}
+	body := strings.Join(lines[1:len(lines)-2], "")
+	want := "$ echo hello\r\nhello\r\n$ exit\r\n\n"
+	if want != body {
+		t.Fatal(cmp.Diff(want, body))
+	}
+	timing, err := os.ReadFile(dir + "/session.timing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, entry := range strings.Split(strings.TrimSpace(string(timing)), "\n") {
+		var delay float64
+		var n int
+		_, err := fmt.Sscanf(entry, "O %f %d", &delay, &n)
+		if err != nil {
+			t.Fatalf("invalid timing entry %q: %v", entry, err)
+		}
+		total += n
+	}
+	if total != len(want)-1 {
+		t.Fatalf("timing file accounts for %d bytes, wanted %d", total, len(want)-1)
+	}
+}
+
+func TestSpySession_ExpiresAfterIdleTimeoutWithWarning(t *testing.T) {
+	t.Parallel()
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	output := &syncBuffer{}
+	transcript := &syncBuffer{}
+	logger := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(reader),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(transcript),
+		shellspy.WithServerLogger(logger),
+		shellspy.WithIdleTimeout(300*time.Millisecond),
+		shellspy.WithExpiryWarning(200*time.Millisecond),
+	)
+	done := make(chan struct{})
+	go func() {
+		session.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not expire")
+	}
+	if !strings.Contains(output.String(), "WARNING this session will end in 200ms if no input is received") {
+		t.Fatalf("wanted idle warning in output, got %q", output.String())
+	}
+	want := "$ \nSession expired: idle for 300ms\n"
+	if transcript.String() != want {
+		t.Fatal(cmp.Diff(want, transcript.String()))
+	}
+	if !strings.Contains(logger.String(), "Session expired: idle for 300ms") {
+		t.Fatalf("wanted reason in server log, got %q", logger.String())
+	}
+}
+
+func TestSpySession_InputResetsIdleTimeout(t *testing.T) {
+	t.Parallel()
+	reader, writer := io.Pipe()
+	output := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(reader),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithServerLogger(io.Discard),
+		shellspy.WithIdleTimeout(300*time.Millisecond),
+	)
+	done := make(chan struct{})
+	go func() {
+		session.Start()
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		fmt.Fprintln(writer, "echo active")
+	}
+	fmt.Fprintln(writer, "exit")
+	<-done
+	if strings.Contains(output.String(), "Session expired") {
+		t.Fatalf("did not expect active session to expire, got %q", output.String())
+	}
+}
+
+func TestSpySession_MaxDurationKillsRunningCommand(t *testing.T) {
+	t.Parallel()
+	output := &syncBuffer{}
+	session := shellspy.NewSpySession(
+		shellspy.WithInput(strings.NewReader("sleep 10\n")),
+		shellspy.WithOutput(output),
+		shellspy.WithTranscript(io.Discard),
+		shellspy.WithServerLogger(io.Discard),
+		shellspy.WithMaxDuration(200*time.Millisecond),
+	)
+	start := time.Now()
+	session.Start()
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected running command to be killed at maximum session length")
+	}
+	if !strings.Contains(output.String(), "Session expired: maximum session length of 200ms reached") {
+		t.Fatalf("wanted expiry message, got %q", output.String())
+	}
+}
+
+func TestSpySession_TerminatesOnExitCommand(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "password", io.Discard)
+	conn := setupConnection(t, s.Address)
+	supplyPassword(t, conn, "password")
+	time.Sleep(100 * time.Millisecond)
+	writeLine(t, conn, "exit")
+	err := waitForBrokenPipe(conn)
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected broken pipe, but got %v", err)
+	}
+}
+
+func TestRemoteShell_DisplaysTerminalPrompt(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("exit\n")
+	buf := &syncBuffer{}
+	shellspy.NewSpySession(shellspy.WithInput(input), shellspy.WithOutput(buf), shellspy.WithTranscript(io.Discard)).Start()
+	want := "$ "
+	got := buf.String()
+	if want != got {
+		t.Fatalf(cmp.Diff(want, got))
+	}
+}
+
+func TestRemoteShell_AuthClosesSessionOnWrongPassword(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "correctPassword", io.Discard)
+	conn := setupConnection(t, s.Address)
+	line := readLine(t, conn)
+	if line != "Enter Password: " {
+		t.Fatalf("wanted 'Enter Password: ', got %s", line)
+	}
+	writeLine(t, conn, "wrongPassword")
+	line = readLine(t, conn)
+	if line != "Incorrect Password: Closing connection" {
+		t.Fatalf("wanted 'Incorrect Password: Closing connection', got %s", line)
+	}
+	err := waitForBrokenPipe(conn)
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected error, but got %q", err)
+	}
+}
+func TestRemoteShell_ShowsSessionIDAtLoginAndInServerLog(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "correctPassword", buf)
+	conn := setupConnection(t, s.Address)
+	supplyPassword(t, conn, "correctPassword")
+	scan := bufio.NewScanner(conn)
+	scan.Scan()
+	scan.Scan()
+	line := scan.Text()
+	id := strings.TrimPrefix(line, "Session ID: ")
+	if id == line || !sessionIDs.MatchString(id) {
+		t.Fatalf("wanted 'Session ID: <id>', got %q", line)
+	}
+	want := fmt.Sprintf("SUCCESSFUL LOGIN from %s session %s", conn.LocalAddr(), id)
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+	onlyTranscript(t, s.TranscriptDirectory, "transcript-"+id+".txt")
+}
+
+func TestRemoteShell_AuthKeepsSessionAliveOnCorrectPassword(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "correctPassword", io.Discard)
+	conn := setupConnection(t, s.Address)
+	line := readLine(t, conn)
+	if line != "Enter Password: " {
+		t.Fatalf("wanted 'Enter Password: ', got %s", line)
+	}
+	writeLine(t, conn, "correctPassword")
+	line = readLine(t, conn)
+	if line != "Welcome to the remote shell!" {
+		t.Fatalf("wanted 'Welcome to the remote shell!', got %s", line)
+	}
+	err := waitForBrokenPipe(conn)
+	if err != nil {
+		t.Fatalf("expected no error, but got %q", err)
+	}
+}
+
+func TestAuthIsFalseForErrorOnRead(t *testing.T) {
+	t.Parallel()
+	conn := ErrConn{iotest.ErrReader(errors.New("faulty read"))}
+	s := setupRemoteServer(t, "correctPassword", io.Discard)
+	if s.Auth(conn) {
+		t.Fatal(true)
+	}
+}
+func TestAuthIsFalseForIncorrectPassword(t *testing.T) {
+	t.Parallel()
+	conn := &bytes.Buffer{}
+	fmt.Fprintln(conn, "incorrectPassword")
+	s := setupRemoteServer(t, "correctPassword", io.Discard)
+	if s.Auth(conn) {
+		t.Fatal(true)
+	}
+}
+
+func TestAuthIsTrueForCorrectPassword(t *testing.T) {
+	t.Parallel()
+	conn := &bytes.Buffer{}
+	fmt.Fprintln(conn, "correctPassword")
+	s := setupRemoteServer(t, "correctPassword", io.Discard)
+	if !s.Auth(conn) {
+		t.Fatal(false)
+	}
+}
+
+func TestAuthIsTrueForPasswordMatchingHash(t *testing.T) {
+	t.Parallel()
+	hash, err := shellspy.HashPassword("correctPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := shellspy.NewServer("", "", t.TempDir())
+	s.PasswordHash = hash
+	conn := &bytes.Buffer{}
+	fmt.Fprintln(conn, "correctPassword")
+	if !s.Auth(conn) {
+		t.Fatal(false)
+	}
+}
+
+func TestAuthIsFalseForPasswordNotMatchingHash(t *testing.T) {
+	t.Parallel()
+	hash, err := shellspy.HashPassword("correctPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := shellspy.NewServer("", "correctPassword", t.TempDir())
+	s.PasswordHash = hash
+	conn := &bytes.Buffer{}
+	fmt.Fprintln(conn, "incorrectPassword")
+	if s.Auth(conn) {
+		t.Fatal(true)
+	}
+}
+
+func TestAuthWithUsersChallengesForUsernameAndPassword(t *testing.T) {
+	t.Parallel()
+	s := shellspy.NewServer("", "", t.TempDir())
+	s.Users = map[string]string{"alice": hashPassword(t, "alicePassword")}
+	output := &bytes.Buffer{}
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("alice\nalicePassword\n"), output}
+	if !s.Auth(conn) {
+		t.Fatal(false)
+	}
+	want := "Enter Username: \nEnter Password: \n"
+	got := output.String()
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestAuthWithUsersIsFalseForAnotherUsersPassword(t *testing.T) {
+	t.Parallel()
+	s := shellspy.NewServer("", "", t.TempDir())
+	s.Users = map[string]string{
+		"alice": hashPassword(t, "alicePassword"),
+		"bob":   hashPassword(t, "bobPassword"),
+	}
+	conn := &bytes.Buffer{}
+	fmt.Fprintln(conn, "alice")
+	fmt.Fprintln(conn, "bobPassword")
+	if s.Auth(conn) {
+		t.Fatal(true)
+	}
+}
+
+func TestAuthWithUsersIsFalseForUnknownUser(t *testing.T) {
+	t.Parallel()
+	s := shellspy.NewServer("", "sharedPassword", t.TempDir())
+	s.Users = map[string]string{"alice": hashPassword(t, "alicePassword")}
+	conn := &bytes.Buffer{}
+	fmt.Fprintln(conn, "mallory")
+	fmt.Fprintln(conn, "sharedPassword")
+	if s.Auth(conn) {
+		t.Fatal(true)
+	}
+}
+
+func TestServer_WritesTranscriptsUsingTranscriptTemplate(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "", io.Discard, func(s *shellspy.Server) {
+		s.Users = map[string]string{"alice": hashPassword(t, "alicePassword")}
+		s.TranscriptTemplate = "{date}/{user}/{ip}-{id}.log"
+	})
+	conn := setupConnection(t, s.Address)
+	readLine(t, conn)
+	writeLine(t, conn, "alice")
+	supplyPassword(t, conn, "alicePassword")
+	writeLine(t, conn, "exit")
+	output := readUntilClosed(t, conn)
+	if !strings.Contains(output, "Welcome to the remote shell!\nSession ID: ") {
+		t.Fatalf("wanted welcome and session ID, got %q", output)
+	}
+	dir := filepath.Join(s.TranscriptDirectory, time.Now().UTC().Format("2006-01-02"), "alice")
+	transcript, err := os.ReadFile(onlyTranscript(t, dir, "127.0.0.1-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# identity: user=alice\n$ exit\n"
+	got := string(transcript)
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestExpandTranscriptTemplate_(t *testing.T) {
+	t.Parallel()
+	fields := map[string]string{"id": "20240501T093000Z-1f2e3d4c", "user": "", "ip": "::1", "date": "2024-05-01", "hostname": "box"}
+	cases := map[string]struct {
+		template string
+		want     string
+	}{
+		"substitutes fields": {
+			template: "{hostname}/{date}/{id}.log",
+			want:     "box/2024-05-01/20240501T093000Z-1f2e3d4c.log",
+		},
+		"replaces empty values and unsafe characters": {
+			template: "{user}/{ip}-{id}.log",
+			want:     "_/__1-20240501T093000Z-1f2e3d4c.log",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := shellspy.ExpandTranscriptTemplate(tc.template, fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want != got {
+				t.Fatal(cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
+
+func TestExpandTranscriptTemplate_RejectsInvalidTemplates(t *testing.T) {
+	t.Parallel()
+	fields := map[string]string{"id": "1", "user": ".."}
+	for _, template := range []string{"{unknown}-{id}.log", "{ID}-{id}.log", "{user_name}-{id}.log", "{date}/{user}.log", "../{id}.log", "/var/log/{id}.log", ""} {
+		_, err := shellspy.ExpandTranscriptTemplate(template, fields)
+		if err == nil {
+			t.Errorf("wanted error for template %q", template)
+		}
+	}
+	got, err := shellspy.ExpandTranscriptTemplate("{user}/{id}.log", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "__/1.log" {
+		t.Fatalf("wanted user .. to be replaced, got %q", got)
+	}
+}
+
+func TestServerWithUsers_RecordsUsernameInLogTranscriptAndFileName(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "", buf, func(s *shellspy.Server) {
+		s.Users = map[string]string{"alice": hashPassword(t, "alicePassword")}
+	})
+	conn := setupConnection(t, s.Address)
+	readLine(t, conn)
+	writeLine(t, conn, "alice")
+	supplyPassword(t, conn, "alicePassword")
+	writeLine(t, conn, "exit")
+	output := readUntilClosed(t, conn)
+	if !strings.Contains(output, "Welcome to the remote shell!\nSession ID: ") {
+		t.Fatalf("wanted welcome and session ID, got %q", output)
+	}
+	wantLog := fmt.Sprintf("SUCCESSFUL LOGIN from %s as user=alice", conn.LocalAddr())
+	if !strings.Contains(buf.String(), wantLog) {
+		t.Fatalf("wanted server log to contain %q, got %q", wantLog, buf.String())
+	}
+	transcript, err := os.ReadFile(onlyTranscript(t, s.TranscriptDirectory, "transcript-alice-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# identity: user=alice\n$ exit\n"
+	got := string(transcript)
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestLoadEnvFile_ReadsVariablesSkippingCommentsAndBlankLines(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/session.env"
+	err := os.WriteFile(path, []byte("# session environment\n\nPATH=/usr/bin:/bin\nGREETING=hello world\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := shellspy.LoadEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"PATH=/usr/bin:/bin", "GREETING=hello world"}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestLoadUsersFile_ReadsHtpasswdStyleEntries(t *testing.T) {
+	t.Parallel()
+	hash := hashPassword(t, "alicePassword")
+	path := t.TempDir() + "/users"
+	err := os.WriteFile(path, []byte("# operators\n\nalice:"+hash+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := shellspy.LoadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"alice": hash}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestLoadUsersFile_RejectsInvalidEntries(t *testing.T) {
+	t.Parallel()
+	hash := hashPassword(t, "password")
+	cases := map[string]string{
+		"missing hash":          "alice\n",
+		"plaintext password":    "alice:password\n",
+		"path in username":      "../alice:" + hash + "\n",
+		"no users in file":      "# nobody here\n",
+		"space in the username": "ali ce:" + hash + "\n",
+	}
+	for name, contents := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := t.TempDir() + "/users"
+			err := os.WriteFile(path, []byte(contents), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = shellspy.LoadUsersFile(path)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestServer_DelegatesToCustomAuthenticator(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.Authenticator = fakeAuthenticator{identity: shellspy.Identity{Username: "carol"}}
+	})
+	conn := setupConnection(t, s.Address)
+	line := readLine(t, conn)
+	if line != "Welcome to the remote shell!" {
+		t.Fatalf("wanted 'Welcome to the remote shell!', got %s", line)
+	}
+	want := fmt.Sprintf("SUCCESSFUL LOGIN from %s as user=carol", conn.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_LogsAuthenticatorErrors(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.Authenticator = fakeAuthenticator{err: errors.New("directory unavailable")}
+	})
+	conn := setupConnection(t, s.Address)
+	err := waitForBrokenPipe(conn)
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected broken pipe, but got %v", err)
+	}
+	want := fmt.Sprintf("FAILED LOGIN from %s: directory unavailable", conn.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_KeepsTranscriptsInsideDirectoryForUnsafeUsernames(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "password", io.Discard, func(s *shellspy.Server) {
+		s.Authenticator = fakeAuthenticator{identity: shellspy.Identity{Username: "../../escaped"}}
+	})
+	conn := setupConnection(t, s.Address)
+	writeLine(t, conn, "exit")
+	readUntilClosed(t, conn)
+	got := numberOfFilesInFolder(s.TranscriptDirectory)
+	if got != 2 {
+		t.Fatalf("expected transcript and metadata files in transcript folder but got %d files", got)
+	}
+}
+
+func TestCommandAuthenticator_(t *testing.T) {
+	t.Parallel()
+	script := writeAuthScript(t, `read user; read pass; read addr
+case "$pass" in
+	secret) printf '{"username":"%s","attributes":{"addr":"%s","env":"%s"}}' "$user" "$addr" "$SHELLSPY_USERNAME" ;;
+	slow) sleep 5 ;;
+	garbage) echo not json ;;
+	*) exit 1 ;;
+esac`)
+	a := shellspy.CommandAuthenticator{Path: script, Timeout: 200 * time.Millisecond}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+	t.Run("accepts login when command prints identity", func(t *testing.T) {
+		got, err := a.Authenticate(fakeConn("dave\nsecret\n"), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := shellspy.Identity{
+			Username:   "dave",
+			Attributes: map[string]string{"addr": "127.0.0.1:1234", "env": "dave"},
+		}
+		if !cmp.Equal(want, got) {
+			t.Fatal(cmp.Diff(want, got))
+		}
+	})
+	t.Run("rejects login when command exits non zero", func(t *testing.T) {
+		got, err := a.Authenticate(fakeConn("dave\nwrong\n"), addr)
+		if !errors.Is(err, shellspy.ErrAuthFailed) {
+			t.Fatalf("wanted ErrAuthFailed, got %v", err)
+		}
+		if got.Username != "dave" {
+			t.Fatalf("wanted attempted username 'dave', got %q", got.Username)
+		}
+	})
+	t.Run("fails when command times out", func(t *testing.T) {
+		_, err := a.Authenticate(fakeConn("dave\nslow\n"), addr)
+		if err == nil || errors.Is(err, shellspy.ErrAuthFailed) || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("wanted timeout error, got %v", err)
+		}
+	})
+	t.Run("fails when command prints invalid identity", func(t *testing.T) {
+		_, err := a.Authenticate(fakeConn("dave\ngarbage\n"), addr)
+		if err == nil || errors.Is(err, shellspy.ErrAuthFailed) || !strings.Contains(err.Error(), "invalid identity") {
+			t.Fatalf("wanted invalid identity error, got %v", err)
+		}
+	})
+}
+
+func TestPrompt_DoesNotConsumeInputBeyondTheLine(t *testing.T) {
+	t.Parallel()
+	input := strings.NewReader("password\necho hello\n")
+	output := &bytes.Buffer{}
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{input, output}
+	got, err := shellspy.Prompt(conn, "Enter Password: ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "password" {
+		t.Fatalf("wanted 'password', got %q", got)
+	}
+	rest, err := io.ReadAll(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "echo hello\n" {
+		t.Fatalf("wanted remaining input 'echo hello\\n', got %q", rest)
+	}
+	if output.String() != "Enter Password: \n" {
+		t.Fatalf("wanted prompt 'Enter Password: \\n', got %q", output.String())
+	}
+}
+
+func TestLoginLimiter_BansAfterMaxFailuresWithinWindow(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	l := testLoginLimiter(buf)
+	for i := 0; i < 2; i++ {
+		l.Failure("10.0.0.1", "alice")
+		if _, banned := l.Banned("10.0.0.1", ""); banned {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	l.Failure("10.0.0.1", "alice")
+	if _, banned := l.Banned("10.0.0.1", ""); !banned {
+		t.Fatal("expected ip to be banned")
+	}
+	if _, banned := l.Banned("10.0.0.2", "alice"); !banned {
+		t.Fatal("expected username to be banned from any ip")
+	}
+	if _, banned := l.Banned("10.0.0.2", "bob"); banned {
+		t.Fatal("did not expect unrelated ip and username to be banned")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, banned := l.Banned("10.0.0.1", "alice"); banned {
+		t.Fatal("expected ban to have expired")
+	}
+	log := buf.String()
+	for _, want := range []string{"LOGIN BAN START ip=10.0.0.1", "LOGIN BAN START user=alice", "LOGIN BAN END ip=10.0.0.1", "LOGIN BAN END user=alice"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("wanted log to contain %q, got %q", want, log)
+		}
+	}
+}
+
+func TestLoginLimiter_DelaysGrowExponentially(t *testing.T) {
+	t.Parallel()
+	l := testLoginLimiter(io.Discard)
+	l.MaxFailures = 0
+	l.BaseDelay = time.Second
+	l.MaxDelay = 3 * time.Second
+	var got []time.Duration
+	for i := 0; i < 4; i++ {
+		got = append(got, l.Failure("10.0.0.1", ""))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestLoginLimiter_SuccessForgetsFailures(t *testing.T) {
+	t.Parallel()
+	l := testLoginLimiter(io.Discard)
+	l.Failure("10.0.0.1", "alice")
+	l.Failure("10.0.0.1", "alice")
+	l.Success("10.0.0.1", "alice")
+	l.Failure("10.0.0.1", "alice")
+	if _, banned := l.Banned("10.0.0.1", "alice"); banned {
+		t.Fatal("did not expect failures before a success to count")
+	}
+}
+
+func TestLoginLimiter_ForgetsLeastRecentFailuresBeyondMaxTracked(t *testing.T) {
+	t.Parallel()
+	l := testLoginLimiter(io.Discard)
+	l.MaxTracked = 2
+	l.Failure("", "alice")
+	l.Failure("", "alice")
+	l.Failure("", "bob")
+	l.Failure("", "carol")
+	l.Failure("", "alice")
+	if _, banned := l.Banned("", "alice"); banned {
+		t.Fatal("did not expect failures forgotten to make room for others to count")
+	}
+	l.Failure("", "carol")
+	l.Failure("", "carol")
+	if _, banned := l.Banned("", "carol"); !banned {
+		t.Fatal("expected failures still tracked to count")
+	}
+}
+
+func TestLoginLimiter_PersistsBansAcrossRestarts(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/bans.json"
+	l := testLoginLimiter(io.Discard)
+	l.BanDuration = time.Hour
+	l.StatePath = path
+	for i := 0; i < 3; i++ {
+		l.Failure("10.0.0.1", "")
+	}
+	restarted := testLoginLimiter(io.Discard)
+	restarted.StatePath = path
+	err := restarted.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, banned := restarted.Banned("10.0.0.1", ""); !banned {
+		t.Fatal("expected ban to survive restart")
+	}
+}
+
+func TestServer_RefusesConnectionsFromBannedIP(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "correctPassword", buf, func(s *shellspy.Server) {
+		s.Limiter = testLoginLimiter(io.Discard)
+		s.Limiter.BanDuration = time.Hour
+	})
+	for i := 0; i < 3; i++ {
+		conn := setupConnection(t, s.Address)
+		supplyPassword(t, conn, "wrongPassword")
+		readLine(t, conn)
+	}
+	conn := setupConnection(t, s.Address)
+	line := readLine(t, conn)
+	if line != "Too many failed logins: Closing connection" {
+		t.Fatalf("wanted 'Too many failed logins: Closing connection', got %s", line)
+	}
+	readUntilClosed(t, conn)
+	want := fmt.Sprintf("LOGIN BLOCKED from %s", conn.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_GivesBannedUsernameSameReplyWhateverThePassword(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "", buf, func(s *shellspy.Server) {
+		s.Users = map[string]string{"alice": hashPassword(t, "alicePassword")}
+		s.Limiter = testLoginLimiter(io.Discard)
+		s.Limiter.BanDuration = time.Hour
+	})
+	for i := 0; i < 3; i++ {
+		s.Limiter.Failure("192.0.2.1", "alice")
+	}
+	var replies []string
+	for _, password := range []string{"alicePassword", "wrongPassword"} {
+		conn := setupConnection(t, s.Address)
+		readLine(t, conn)
+		writeLine(t, conn, "alice")
+		supplyPassword(t, conn, password)
+		replies = append(replies, readUntilClosed(t, conn))
+	}
+	if replies[0] != replies[1] {
+		t.Fatal(cmp.Diff(replies[1], replies[0]))
+	}
+	if replies[0] != "Incorrect Password: Closing connection\n" {
+		t.Fatalf("wanted banned login to be rejected as a wrong password, got %q", replies[0])
+	}
+	if strings.Contains(buf.String(), "SUCCESSFUL LOGIN") {
+		t.Fatalf("wanted no successful login during the ban, got %q", buf.String())
+	}
+}
+
+func TestServer_DelaysFailedLoginReplyNoLongerThanAuthTimeout(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "correctPassword", io.Discard, func(s *shellspy.Server) {
+		s.Limiter = testLoginLimiter(io.Discard)
+		s.Limiter.BaseDelay = time.Minute
+		s.Limiter.MaxDelay = time.Minute
+		s.AuthTimeout = 300 * time.Millisecond
+	})
+	conn := setupConnection(t, s.Address)
+	start := time.Now()
+	supplyPassword(t, conn, "wrongPassword")
+	output := readUntilClosed(t, conn)
+	if strings.Contains(output, "Incorrect Password") {
+		t.Fatalf("wanted no reply before the delay, got %q", output)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected delay to end with the auth timeout")
+	}
+}
+
+func TestServer_ClosesConnectionsThatDoNotLogInBeforeAuthTimeout(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.AuthTimeout = 100 * time.Millisecond
+	})
+	conn := setupConnection(t, s.Address)
+	readLine(t, conn)
+	_, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("LOGIN TIMEOUT from %s after 100ms", conn.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_AuthTimeoutDoesNotApplyOnceLoggedIn(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "password", io.Discard, func(s *shellspy.Server) {
+		s.AuthTimeout = 100 * time.Millisecond
+	})
+	conn := setupConnection(t, s.Address)
+	supplyPassword(t, conn, "password")
+	readLine(t, conn)
+	time.Sleep(200 * time.Millisecond)
+	writeLine(t, conn, "echo still here")
+	scan := bufio.NewScanner(conn)
+	if !scan.Scan() {
+		t.Fatalf("connection closed: %v", scan.Err())
+	}
+	if got := scan.Text(); !strings.HasSuffix(got, "still here") {
+		t.Fatalf("wanted 'still here', got %q", got)
+	}
+}
+
+func TestServer_RejectsConnectionsBeyondMaxUnauthenticated(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.MaxUnauthenticated = 1
+	})
+	first := setupConnection(t, s.Address)
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	line := readLine(t, second)
+	if line != "Too many pending logins: Closing connection" {
+		t.Fatalf("wanted 'Too many pending logins: Closing connection', got %s", line)
+	}
+	writeLine(t, first, "password")
+	readLine(t, first)
+	third := setupConnection(t, s.Address)
+	line = readLine(t, third)
+	if line != "Enter Password: " {
+		t.Fatalf("wanted 'Enter Password: ' once first connection logged in, got %s", line)
+	}
+	want := fmt.Sprintf("LOGIN REJECTED from %s: too many unauthenticated connections", second.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_RejectsConnectionsBeyondMaxConnectionsPerIP(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.MaxConnectionsPerIP = 1
+	})
+	first := setupConnection(t, s.Address)
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	line := readLine(t, second)
+	if line != "Server busy: too many connections, try again later" {
+		t.Fatalf("wanted 'Server busy: too many connections, try again later', got %s", line)
+	}
+	want := fmt.Sprintf("CONNECTION REJECTED from %s: server busy (1 connections open from this address)", second.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_RejectsSessionsBeyondMaxSessions(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.MaxSessions = 1
+	})
+	first := setupConnection(t, s.Address)
+	supplyPassword(t, first, "password")
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	supplyPassword(t, second, "password")
+	line := readLine(t, second)
+	if line != "Server busy: too many sessions, try again later" {
+		t.Fatalf("wanted 'Server busy: too many sessions, try again later', got %s", line)
+	}
+	want := fmt.Sprintf("SESSION REJECTED from %s: server busy (1 sessions active)", second.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServer_QueuesSessionsUntilOneEnds(t *testing.T) {
+	t.Parallel()
+	buf := &syncBuffer{}
+	s := setupRemoteServer(t, "password", buf, func(s *shellspy.Server) {
+		s.MaxSessions = 1
+		s.SessionQueueSize = 1
+		s.SessionQueueTimeout = 5 * time.Second
+	})
+	first := setupConnection(t, s.Address)
+	supplyPassword(t, first, "password")
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	supplyPassword(t, second, "password")
+	line := readLine(t, second)
+	if line != "Server busy: waiting for a free session" {
+		t.Fatalf("wanted 'Server busy: waiting for a free session', got %s", line)
+	}
+	writeLine(t, first, "exit")
+	line = readLine(t, second)
+	if line != "Welcome to the remote shell!" {
+		t.Fatalf("wanted 'Welcome to the remote shell!' once first session ended, got %s", line)
+	}
+	want := fmt.Sprintf("SESSION QUEUED from %s", second.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
 	}
 }
 
-func TestAuthIsTrueForCorrectPassword(t *testing.T) {
+func TestServer_RejectsQueuedSessionsAfterSessionQueueTimeout(t *testing.T) {
 	t.Parallel()
-	conn := &bytes.Buffer{}
-	fmt.Fprintln(conn, "correctPassword")
-	s := setupRemoteServer(t, "correctPassword", io.Discard)
-	if !s.Auth(conn) {
-		t.Fatal(false)
+	s := setupRemoteServer(t, "password", &syncBuffer{}, func(s *shellspy.Server) {
+		s.MaxSessions = 1
+		s.SessionQueueSize = 1
+		s.SessionQueueTimeout = 50 * time.Millisecond
+	})
+	first := setupConnection(t, s.Address)
+	supplyPassword(t, first, "password")
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	supplyPassword(t, second, "password")
+	scan := bufio.NewScanner(second)
+	var got []string
+	for scan.Scan() {
+		got = append(got, scan.Text())
+	}
+	want := []string{
+		"Server busy: waiting for a free session",
+		"Server busy: no session became free, try again later",
+	}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
 	}
 }
 
 func TestServerSideLogging(t *testing.T) {
-	buf := &bytes.Buffer{}
+	buf := &syncBuffer{}
 	s := setupRemoteServer(t, "correctPassword", buf)
 	c1 := setupConnection(t, s.Address)
 	c2 := setupConnection(t, s.Address)
@@ -249,21 +1871,23 @@ func TestServerSideLogging(t *testing.T) {
 	fmt.Fprintln(c2, "incorrectPassword")
 	fmt.Fprintln(c3, "correctPassword")
 
-	time.Sleep(50 * time.Millisecond)
-	got := strings.Split(buf.String(), "\n")
+	readUntil(t, c1, "$ ")
+	readUntilClosed(t, c2)
+	readUntil(t, c3, "$ ")
+	got := strings.Split(sessionIDs.ReplaceAllString(buf.String(), "ID"), "\n")
 	got = got[0 : len(got)-1]
 
 	want := []string{
-		fmt.Sprintf("Starting listener on %s", s.Address),
-		"Listener created.",
 		fmt.Sprintf("Accepting connection from %s", c1.LocalAddr()),
 		fmt.Sprintf("Accepting connection from %s", c2.LocalAddr()),
 		fmt.Sprintf("Accepting connection from %s", c3.LocalAddr()),
-		fmt.Sprintf("SUCCESSFUL LOGIN from %s", c1.LocalAddr()),
-		fmt.Sprintf("SUCCESSFUL LOGIN from %s", c3.LocalAddr()),
+		fmt.Sprintf("SUCCESSFUL LOGIN from %s session ID", c1.LocalAddr()),
+		fmt.Sprintf("SUCCESSFUL LOGIN from %s session ID", c3.LocalAddr()),
 		fmt.Sprintf("FAILED LOGIN from %s", c2.LocalAddr()),
-		fmt.Sprintf("Transcript for new session available at %s/transcript-%d.txt", s.TranscriptDirectory, 1),
-		fmt.Sprintf("Transcript for new session available at %s/transcript-%d.txt", s.TranscriptDirectory, 2),
+		fmt.Sprintf("Transcript for new session available at %s/transcript-ID.txt", s.TranscriptDirectory),
+		fmt.Sprintf("Transcript for new session available at %s/transcript-ID.txt", s.TranscriptDirectory),
+		fmt.Sprintf("Metadata for new session available at %s/transcript-ID.meta.json", s.TranscriptDirectory),
+		fmt.Sprintf("Metadata for new session available at %s/transcript-ID.meta.json", s.TranscriptDirectory),
 	}
 	less := func(a, b string) bool { return a < b }
 	if !cmp.Equal(want, got, cmpopts.SortSlices(less)) {
@@ -283,16 +1907,18 @@ func TestServerSideTranscriptsAreOnePerSuccessfulConnection(t *testing.T) {
 	c3 := setupConnection(t, s.Address)
 	fmt.Fprintln(c3, "correctPassword")
 
-	time.Sleep(50 * time.Millisecond)
+	readUntil(t, c1, "$ ")
+	readUntilClosed(t, c2)
+	readUntil(t, c3, "$ ")
 	got := numberOfFilesInFolder(s.TranscriptDirectory)
 
-	if got != 2 {
-		t.Fatalf("expected 2 files in transcript folder but got %d", got)
+	if got != 4 {
+		t.Fatalf("expected 2 transcripts and 2 metadata files in transcript folder but got %d files", got)
 	}
 }
 
 func TestServerLogsErrorWhenTranscriptUnavailable(t *testing.T) {
-	buf := &bytes.Buffer{}
+	buf := &syncBuffer{}
 
 	s := setupRemoteServer(t, "correctPassword", buf)
 	os.Chmod(s.TranscriptDirectory, 0o444)
@@ -300,16 +1926,14 @@ func TestServerLogsErrorWhenTranscriptUnavailable(t *testing.T) {
 
 	fmt.Fprintln(c1, "correctPassword")
 
-	time.Sleep(50 * time.Millisecond)
-	got := strings.Split(buf.String(), "\n")
+	readUntil(t, c1, "$ ")
+	got := strings.Split(sessionIDs.ReplaceAllString(buf.String(), "ID"), "\n")
 	got = got[0 : len(got)-1]
 
 	want := []string{
-		fmt.Sprintf("Starting listener on %s", s.Address),
-		"Listener created.",
 		fmt.Sprintf("Accepting connection from %s", c1.LocalAddr()),
-		fmt.Sprintf("SUCCESSFUL LOGIN from %s", c1.LocalAddr()),
-		fmt.Sprintf("open %s/transcript-%d.txt: permission denied", s.TranscriptDirectory, 1),
+		fmt.Sprintf("SUCCESSFUL LOGIN from %s session ID", c1.LocalAddr()),
+		fmt.Sprintf("open %s/transcript-ID.txt: permission denied", s.TranscriptDirectory),
 	}
 	less := func(a, b string) bool { return a < b }
 	if !cmp.Equal(want, got, cmpopts.SortSlices(less)) {
@@ -317,6 +1941,341 @@ func TestServerLogsErrorWhenTranscriptUnavailable(t *testing.T) {
 	}
 }
 
+func TestServerShutdown_CausesServeToReturnErrServerClosed(t *testing.T) {
+	t.Parallel()
+	l := setupListener(t)
+	s := shellspy.NewServer(l.Addr().String(), "password", t.TempDir())
+	s.Logger = io.Discard
+	errs := make(chan error)
+	go func() {
+		errs <- s.Serve(l)
+	}()
+	setupConnection(t, s.Address).Close()
+	err := s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errs
+	if !errors.Is(err, shellspy.ErrServerClosed) {
+		t.Fatalf("wanted ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServerShutdown_WaitsForActiveSessionsToExit(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "password", io.Discard)
+	conn := setupConnection(t, s.Address)
+	supplyPassword(t, conn, "password")
+	readLine(t, conn)
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected shutdown to wait for active session, but it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	writeLine(t, conn, "exit")
+	err := <-shutdown
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerShutdown_ClosesSessionsAndFlushesTranscriptsWhenContextExpires(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "password", io.Discard)
+	conn := setupConnection(t, s.Address)
+	supplyPassword(t, conn, "password")
+	writeLine(t, conn, "echo hello")
+	readUntil(t, conn, "hello\n$ ")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wanted deadline exceeded, got %v", err)
+	}
+	err = waitForBrokenPipe(conn)
+	if !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected broken pipe, but got %v", err)
+	}
+	transcript, err := os.ReadFile(onlyTranscript(t, s.TranscriptDirectory, "transcript-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "$ echo hello\nhello\n$ "
+	got := withoutAnnotations(string(transcript))
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestServerClose_KillsRunningCommands(t *testing.T) {
+	t.Parallel()
+	s := setupRemoteServer(t, "password", io.Discard)
+	conn := setupConnection(t, s.Address)
+	supplyPassword(t, conn, "password")
+	writeLine(t, conn, "echo started; sleep 10")
+	readUntil(t, conn, "started\n")
+	start := time.Now()
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected running command to be killed on close")
+	}
+}
+
+func TestServeTLS_AcceptsPasswordOverEncryptedConnection(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	err := shellspy.GenerateSelfSignedCert(certFile, keyFile, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := setupListener(t)
+	buf := &syncBuffer{}
+	s := shellspy.NewServer(l.Addr().String(), "password", dir)
+	s.Logger = buf
+	t.Cleanup(func() { s.Close() })
+	go s.ServeTLS(l, certFile, keyFile)
+	conn, err := tls.Dial("tcp", s.Address, &tls.Config{RootCAs: certPool(t, certFile)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	supplyPassword(t, conn, "password")
+	line := readLine(t, conn)
+	if line != "Welcome to the remote shell!" {
+		t.Fatalf("wanted 'Welcome to the remote shell!', got %s", line)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := shellspy.CertificateFingerprint(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), fingerprint) {
+		t.Fatalf("wanted server log to contain fingerprint %s, got %q", fingerprint, buf.String())
+	}
+}
+
+func TestServeTLS_ClosesRejectedConnectionsThatNeverCompleteHandshake(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	err := shellspy.GenerateSelfSignedCert(certFile, keyFile, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := setupListener(t)
+	buf := &syncBuffer{}
+	s := shellspy.NewServer(l.Addr().String(), "password", dir)
+	s.Logger = buf
+	s.MaxUnauthenticated = 1
+	s.AuthTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { s.Close() })
+	go s.ServeTLS(l, certFile, keyFile)
+	first, err := tls.Dial("tcp", s.Address, &tls.Config{RootCAs: certPool(t, certFile)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(second)
+	if err != nil {
+		t.Fatalf("wanted server to close connection stuck in TLS handshake, got %v", err)
+	}
+	want := fmt.Sprintf("LOGIN REJECTED from %s: too many unauthenticated connections", second.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServeTLS_ClosesConnectionsBeyondMaxConnectionsThatNeverCompleteHandshake(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	err := shellspy.GenerateSelfSignedCert(certFile, keyFile, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := setupListener(t)
+	buf := &syncBuffer{}
+	s := shellspy.NewServer(l.Addr().String(), "password", dir)
+	s.Logger = buf
+	s.MaxConnections = 1
+	s.AuthTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { s.Close() })
+	go s.ServeTLS(l, certFile, keyFile)
+	first, err := tls.Dial("tcp", s.Address, &tls.Config{RootCAs: certPool(t, certFile)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	readLine(t, first)
+	second := setupConnection(t, s.Address)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(second)
+	if err != nil {
+		t.Fatalf("wanted server to close connection stuck in TLS handshake, got %v", err)
+	}
+	want := fmt.Sprintf("CONNECTION REJECTED from %s: server busy (1 connections open)", second.LocalAddr())
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+	}
+}
+
+func TestServeTLS_ReturnsErrorForMissingCertificate(t *testing.T) {
+	t.Parallel()
+	s := shellspy.NewServer("", "password", t.TempDir())
+	s.Logger = io.Discard
+	err := s.ServeTLS(setupListener(t), "missing-cert.pem", "missing-key.pem")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("wanted file not found error, got %v", err)
+	}
+}
+
+func TestGenerateSelfSignedCert_RefusesToOverwriteExistingFiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	err := shellspy.GenerateSelfSignedCert(dir+"/cert.pem", dir+"/key.pem", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = shellspy.GenerateSelfSignedCert(dir+"/cert.pem", dir+"/key.pem", "localhost")
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("wanted file exists error, got %v", err)
+	}
+}
+
+func TestServeTLS_ClientCertAuthSkipsPasswordAndRecordsIdentity(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	buf := &syncBuffer{}
+	s, clientCert := setupMutualTLSServer(t, dir, shellspy.AuthClientCert, buf)
+	conn, err := tls.Dial("tcp", s.Address, &tls.Config{
+		RootCAs:      certPool(t, dir+"/server.pem"),
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := readLine(t, conn)
+	if line != "Welcome to the remote shell!" {
+		t.Fatalf("wanted 'Welcome to the remote shell!', got %s", line)
+	}
+	writeLine(t, conn, "exit")
+	readUntilClosed(t, conn)
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := fmt.Sprintf("subject=%q serial=%X", leaf.Subject.String(), leaf.SerialNumber)
+	wantLog := fmt.Sprintf("SUCCESSFUL LOGIN from %s as %s", conn.LocalAddr(), identity)
+	if !strings.Contains(buf.String(), wantLog) {
+		t.Fatalf("wanted server log to contain %q, got %q", wantLog, buf.String())
+	}
+	transcript, err := os.ReadFile(onlyTranscript(t, dir, "transcript-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHeader := "# identity: " + identity + "\n"
+	if !strings.HasPrefix(string(transcript), wantHeader) {
+		t.Fatalf("wanted transcript to start with %q, got %q", wantHeader, transcript)
+	}
+}
+
+func TestServeTLS_ClientCertAndPasswordAuthStillChallengesForPassword(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, clientCert := setupMutualTLSServer(t, dir, shellspy.AuthClientCertAndPassword, io.Discard)
+	conn, err := tls.Dial("tcp", s.Address, &tls.Config{
+		RootCAs:      certPool(t, dir+"/server.pem"),
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	supplyPassword(t, conn, "password")
+	line := readLine(t, conn)
+	if line != "Welcome to the remote shell!" {
+		t.Fatalf("wanted 'Welcome to the remote shell!', got %s", line)
+	}
+}
+
+func TestServeTLS_ClientCertAuthRejectsClientsWithoutCertificate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	buf := &syncBuffer{}
+	s, _ := setupMutualTLSServer(t, dir, shellspy.AuthClientCert, buf)
+	conn, err := tls.Dial("tcp", s.Address, &tls.Config{RootCAs: certPool(t, dir+"/server.pem")})
+	if err == nil {
+		_, err = bufio.NewReader(conn).ReadString('\n')
+	}
+	if err == nil {
+		t.Fatal("expected connection without client certificate to fail")
+	}
+	waitForLog(t, buf, "TLS handshake failed")
+}
+
+func TestParseAuthMode_(t *testing.T) {
+	t.Parallel()
+	cases := map[string]shellspy.AuthMode{
+		"password":      shellspy.AuthPassword,
+		"cert":          shellspy.AuthClientCert,
+		"cert+password": shellspy.AuthClientCertAndPassword,
+	}
+	for input, want := range cases {
+		got, err := shellspy.ParseAuthMode(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Fatalf("%s: wanted %v, got %v", input, want, got)
+		}
+	}
+	_, err := shellspy.ParseAuthMode("bogus")
+	if err == nil {
+		t.Fatal("expected error for unknown auth mode")
+	}
+}
+
+func TestParseTranscriptFormat_(t *testing.T) {
+	t.Parallel()
+	cases := map[string]shellspy.TranscriptFormat{
+		"text":      shellspy.TranscriptText,
+		"jsonl":     shellspy.TranscriptJSONL,
+		"asciicast": shellspy.TranscriptAsciicast,
+		"script":    shellspy.TranscriptScript,
+	}
+	for input, want := range cases {
+		got, err := shellspy.ParseTranscriptFormat(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Fatalf("%s: wanted %v, got %v", input, want, got)
+		}
+	}
+	_, err := shellspy.ParseTranscriptFormat("bogus")
+	if err == nil {
+		t.Fatal("expected error for unknown transcript format")
+	}
+}
+
 func ExampleServer_Log() {
 	s := shellspy.NewServer("serverAddress", "password", "logDirectory")
 	s.Log("Log simple server messages like this")
@@ -372,6 +2331,49 @@ func readLine(t *testing.T, conn net.Conn) string {
 	return scan.Text()
 }
 
+// readUntilClosed returns everything the server sends on conn until it
+// closes the connection, by which time the session has finished writing
+// its transcript.
+func readUntilClosed(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// readUntil reads from conn until what it has read ends in want. It
+// reads a byte at a time so as not to consume anything after it.
+func readUntil(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var got []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(got), want) {
+		_, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("wanted output ending in %q, got %q and %v", want, got, err)
+		}
+		got = append(got, b[0])
+	}
+}
+
+// waitForLog waits for the server log in buf to contain want, for
+// things the server logs after the client can see any sign of them.
+func waitForLog(t *testing.T, buf *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(buf.String(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted server log to contain %q, got %q", want, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func writeLine(t *testing.T, conn net.Conn, line string) {
 	t.Helper()
 	_, err := fmt.Fprintf(conn, line+"\n")
@@ -398,38 +2400,86 @@ func supplyPassword(t *testing.T, conn net.Conn, password string) {
 	writeLine(t, conn, password)
 }
 
-func getFreeListenerAddress(t *testing.T) (addr string, err error) {
-	listener, err := net.Listen("tcp", ":0")
+func certPool(t *testing.T, certFile string) *x509.CertPool {
+	t.Helper()
+	pem, err := os.ReadFile(certFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = listener.Close()
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		t.Fatalf("no certificates found in %s", certFile)
+	}
+	return pool
+}
+
+func setupMutualTLSServer(t *testing.T, dir string, mode shellspy.AuthMode, logger io.Writer) (*shellspy.Server, tls.Certificate) {
+	t.Helper()
+	err := shellspy.GenerateSelfSignedCert(dir+"/server.pem", dir+"/server-key.pem", "127.0.0.1")
 	if err != nil {
-		return "", err
+		t.Fatal(err)
 	}
-	for i := 0; i < 10; i++ {
-		_, err := net.Dial("tcp", listener.Addr().String())
-		if err != nil {
-			return listener.Addr().String(), nil
-		}
-		time.Sleep(50 * time.Millisecond)
+	err = shellspy.GenerateSelfSignedCert(dir+"/client.pem", dir+"/client-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(dir+"/client.pem", dir+"/client-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := setupListener(t)
+	s := shellspy.NewServer(l.Addr().String(), "password", dir)
+	s.Logger = logger
+	s.AuthMode = mode
+	s.TLSConfig = &tls.Config{ClientCAs: certPool(t, dir+"/client.pem")}
+	t.Cleanup(func() { s.Close() })
+	go s.ServeTLS(l, dir+"/server.pem", dir+"/server-key.pem")
+	return s, clientCert
+}
+
+func testLoginLimiter(logger io.Writer) *shellspy.LoginLimiter {
+	return &shellspy.LoginLimiter{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BanDuration: 200 * time.Millisecond,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    10 * time.Millisecond,
+		Logger:      logger,
 	}
-	return "", fmt.Errorf("listener did not close in a timely fashion")
 }
 
-func setupRemoteServer(t *testing.T, password string, logger io.Writer) *shellspy.Server {
+func hashPassword(t *testing.T, password string) string {
 	t.Helper()
+	hash, err := shellspy.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
 
-	addr, err := getFreeListenerAddress(t)
+func setupListener(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
 	}
+	return listener
+}
+
+func setupRemoteServer(t *testing.T, password string, logger io.Writer, configure ...func(*shellspy.Server)) *shellspy.Server {
+	t.Helper()
+
+	listener := setupListener(t)
 	tempDir := t.TempDir()
-	s := shellspy.NewServer(addr, password, tempDir)
+	s := shellspy.NewServer(listener.Addr().String(), password, tempDir)
 	s.Logger = logger
+	for _, c := range configure {
+		c(s)
+	}
+	t.Cleanup(func() { s.Close() })
 	go func() {
-		err := s.ListenAndServe()
-		if err != nil {
+		err := s.Serve(listener)
+		if err != nil && err != shellspy.ErrServerClosed {
 			panic(err)
 		}
 		if err == nil {
@@ -439,6 +2489,31 @@ func setupRemoteServer(t *testing.T, password string, logger io.Writer) *shellsp
 	return s
 }
 
+// withoutAnnotations removes the exit status and resource usage
+// annotations from a text transcript, as they vary between runs.
+func withoutAnnotations(transcript string) string {
+	return annotations.ReplaceAllString(transcript, "")
+}
+
+var annotations = regexp.MustCompile(`(?m)^# exit=.*\n`)
+
+// sessionIDs matches the identifiers returned by [shellspy.NewSessionID].
+var sessionIDs = regexp.MustCompile(`\d{8}T\d{6}Z-[0-9a-f]{8}`)
+
+// onlyTranscript returns the path of the single file in dir matching
+// pattern, failing the test if there is not exactly one.
+func onlyTranscript(t *testing.T, dir, pattern string) string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("wanted one transcript matching %s in %s, got %q", pattern, dir, matches)
+	}
+	return matches[0]
+}
+
 func numberOfFilesInFolder(path string) int {
 	folder, err := os.Open(path)
 	if err != nil {
@@ -452,6 +2527,51 @@ func numberOfFilesInFolder(path string) int {
 	return len(files)
 }
 
+func fakeConn(input string) io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(input), io.Discard}
+}
+
+func writeAuthScript(t *testing.T, body string) string {
+	t.Helper()
+	path := t.TempDir() + "/auth.sh"
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// syncBuffer is a [bytes.Buffer] that is safe to share between the
+// session's goroutines and the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type fakeAuthenticator struct {
+	identity shellspy.Identity
+	err      error
+}
+
+func (f fakeAuthenticator) Authenticate(conn io.ReadWriter, remoteAddr net.Addr) (shellspy.Identity, error) {
+	return f.identity, f.err
+}
+
 type ErrConn struct {
 	io.Reader
 }
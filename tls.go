@@ -0,0 +1,226 @@
+package shellspy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ListenAndServeTLS listens on the TCP address [Server.Address] and
+// then calls [Server.ServeTLS] to handle incoming connections.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	s.Logf("Starting TLS listener on %s\n", s.Address)
+	listener, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		s.Log(err)
+		return err
+	}
+	s.Log("Listener created.")
+	return s.ServeTLS(listener, certFile, keyFile)
+}
+
+// ServeTLS wraps the listener l in TLS and then calls [Server.Serve].
+// The certificate and key are loaded from certFile and keyFile unless
+// [Server.TLSConfig] already provides a certificate, in which case both
+// may be empty. ServeTLS always closes l before returning.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := s.tlsConfig(certFile, keyFile)
+	if err != nil {
+		s.Log(err)
+		l.Close()
+		return err
+	}
+	return s.Serve(tls.NewListener(l, config))
+}
+
+func (s *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if s.AuthMode.requiresClientCert() {
+		if config.ClientCAs == nil {
+			return nil, fmt.Errorf("client certificate authentication requires TLSConfig.ClientCAs")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	for _, cert := range config.Certificates {
+		fingerprint, err := CertificateFingerprint(cert)
+		if err != nil {
+			return nil, err
+		}
+		s.Logf("TLS certificate fingerprint (SHA-256) %s\n", fingerprint)
+	}
+	return config, nil
+}
+
+// clientCertIdentity describes the verified client certificate in state
+// by its subject and serial number. It returns an empty string if the
+// client did not present a certificate that chains to a trusted CA.
+func clientCertIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	return fmt.Sprintf("subject=%q serial=%X", cert.Subject.String(), cert.SerialNumber)
+}
+
+// LoadCertPool reads a bundle of PEM encoded CA certificates from path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the leaf
+// certificate in cert, formatted the same way as
+// `openssl x509 -fingerprint -sha256`.
+func CertificateFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", fmt.Errorf("no certificate data to fingerprint")
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
+
+// GenerateSelfSignedCert creates a new ECDSA key and a self-signed
+// certificate valid for one year for the supplied hosts, writing them in
+// PEM format to certFile and keyFile. Hosts may be DNS names or IP
+// addresses. The certificate is also valid for client authentication.
+// It will not overwrite existing files.
+func GenerateSelfSignedCert(certFile, keyFile string, hosts ...string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"shellspy"}, CommonName: "shellspy self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600)
+	if err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0o644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tlsFilesFromEnv reads the TLS_CERT and TLS_KEY environment variables.
+// When TLS_SELF_SIGNED is "true" a self-signed certificate is generated
+// on first start, defaulting to cert.pem and key.pem in the working
+// directory. Empty paths mean TLS is disabled.
+func tlsFilesFromEnv() (certFile, keyFile string, err error) {
+	certFile = os.Getenv("TLS_CERT")
+	keyFile = os.Getenv("TLS_KEY")
+	if os.Getenv("TLS_SELF_SIGNED") == "true" {
+		if certFile == "" {
+			certFile = "cert.pem"
+		}
+		if keyFile == "" {
+			keyFile = "key.pem"
+		}
+		_, err := os.Stat(certFile)
+		if os.IsNotExist(err) {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return "", "", err
+			}
+			err = GenerateSelfSignedCert(certFile, keyFile, hostname, "localhost", "127.0.0.1", "::1")
+			if err != nil {
+				return "", "", err
+			}
+			fmt.Printf("Generated self-signed certificate %s and key %s\n", certFile, keyFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return "", "", fmt.Errorf("TLS_CERT and TLS_KEY environment variables must be set together")
+	}
+	return certFile, keyFile, nil
+}
+
+// clientCertConfigFromEnv builds the TLS configuration for client
+// certificate authentication from the TLS_CLIENT_CA environment
+// variable. It returns nil if mode does not use client certificates.
+func clientCertConfigFromEnv(mode AuthMode) (*tls.Config, error) {
+	if !mode.requiresClientCert() {
+		return nil, nil
+	}
+	path := os.Getenv("TLS_CLIENT_CA")
+	if path == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_CA environment variable must be set to use client certificates")
+	}
+	pool, err := LoadCertPool(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  pool,
+	}, nil
+}
@@ -0,0 +1,401 @@
+package shellspy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptFormat selects how a session transcript is written.
+type TranscriptFormat int
+
+const (
+	// TranscriptText writes prompts, input and output interleaved as
+	// plain text, as they appeared on the terminal.
+	TranscriptText TranscriptFormat = iota
+	// TranscriptJSONL writes one JSON event per line. See [WithTranscriptFormat].
+	TranscriptJSONL
+	// TranscriptAsciicast writes an asciicast v2 recording that can be
+	// replayed with `asciinema play`.
+	TranscriptAsciicast
+	// TranscriptScript writes a typescript like script(1), along with a
+	// timing file in its advanced format so that the session can be
+	// replayed with scriptreplay(1).
+	TranscriptScript
+)
+
+// ParseTranscriptFormat converts one of "text", "jsonl", "asciicast" or
+// "script" into a [TranscriptFormat].
+func ParseTranscriptFormat(s string) (TranscriptFormat, error) {
+	switch s {
+	case "text":
+		return TranscriptText, nil
+	case "jsonl":
+		return TranscriptJSONL, nil
+	case "asciicast":
+		return TranscriptAsciicast, nil
+	case "script":
+		return TranscriptScript, nil
+	}
+	return TranscriptText, fmt.Errorf("unknown transcript format %q", s)
+}
+
+// String returns the name of f as accepted by [ParseTranscriptFormat].
+func (f TranscriptFormat) String() string {
+	switch f {
+	case TranscriptJSONL:
+		return "jsonl"
+	case TranscriptAsciicast:
+		return "asciicast"
+	case TranscriptScript:
+		return "script"
+	}
+	return "text"
+}
+
+// Extension returns the file extension, including the dot, used for
+// transcripts in format f.
+func (f TranscriptFormat) Extension() string {
+	switch f {
+	case TranscriptJSONL:
+		return ".jsonl"
+	case TranscriptAsciicast:
+		return ".cast"
+	case TranscriptScript:
+		return ".typescript"
+	}
+	return ".txt"
+}
+
+// event is something that happened during a session, as passed to a
+// [recorder]. Its JSON encoding is the [TranscriptJSONL] format.
+type event struct {
+	Time       time.Time  `json:"time"`
+	Type       string     `json:"type"`
+	SessionID  string     `json:"session_id,omitempty"`
+	Identity   string     `json:"identity,omitempty"`
+	RemoteAddr string     `json:"remote_addr,omitempty"`
+	Stream     string     `json:"stream,omitempty"`
+	Data       string     `json:"data,omitempty"`
+	Command    string     `json:"command,omitempty"`
+	Argv       [][]string `json:"argv,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	Value      *string    `json:"value,omitempty"`
+	Cwd        string     `json:"cwd,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	PipeStatus []int      `json:"pipe_status,omitempty"`
+	Duration   float64    `json:"duration,omitempty"`
+	UserTime   float64    `json:"user_time,omitempty"`
+	SysTime    float64    `json:"sys_time,omitempty"`
+	MaxRSS     int64      `json:"max_rss,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// Event types.
+const (
+	eventStart  = "start"
+	eventPrompt = "prompt"
+	eventInput  = "input"
+	eventOutput = "output"
+	eventExit   = "exit"
+	eventEnv    = "env"
+	eventEnd    = "end"
+)
+
+// Output streams. Messages from shellspy itself, such as errors
+// parsing a command line, are on the shell stream.
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+	streamShell  = "shell"
+)
+
+// recorder writes session events to a transcript.
+type recorder interface {
+	record(e event) error
+}
+
+// newRecorder returns a recorder writing format to w. The timing
+// writer is only used by [TranscriptScript].
+func newRecorder(format TranscriptFormat, w, timing io.Writer) recorder {
+	switch format {
+	case TranscriptJSONL:
+		return jsonlRecorder{enc: json.NewEncoder(w)}
+	case TranscriptAsciicast:
+		return &asciicastRecorder{w: w}
+	case TranscriptScript:
+		return &scriptRecorder{w: w, timing: timing}
+	}
+	return &textRecorder{w: w}
+}
+
+// textRecorder writes the [TranscriptText] format. Lines written to
+// stderr are tagged with a "[stderr] " prefix, and each command that
+// ran is followed by an annotation line such as
+//
+//	# exit=0 time=1.52ms user=1ms sys=0s maxrss=3512KiB cwd=/home/alice
+//
+// Pipelines add the exit status of each stage, as in
+// "# exit=0 pipestatus=1,0 time=...". Resource usage is totalled across
+// the stages, except for maxrss which is that of the largest.
+//
+// Changes to the session environment are noted as "# env NAME=value"
+// or "# env unset NAME".
+type textRecorder struct {
+	w io.Writer
+	// midLine is true if the last output did not end in a newline.
+	midLine bool
+	// stderr is true if that output was from stderr.
+	stderr bool
+}
+
+// stderrTag marks lines from stderr in a [TranscriptText] transcript.
+const stderrTag = "[stderr] "
+
+func (r *textRecorder) record(e event) error {
+	var err error
+	switch e.Type {
+	case eventStart:
+		if e.Identity != "" {
+			_, err = fmt.Fprintf(r.w, "# identity: %s\n", e.Identity)
+		}
+	case eventPrompt, eventOutput:
+		stderr := e.Stream == streamStderr
+		data := e.Data
+		if stderr {
+			data = tagLines(data, r.midLine && r.stderr)
+		}
+		if r.midLine && r.stderr != stderr && e.Type == eventOutput {
+			data = "\n" + data
+		}
+		_, err = io.WriteString(r.w, data)
+		r.midLine = !strings.HasSuffix(e.Data, "\n")
+		r.stderr = stderr
+	case eventInput:
+		_, err = fmt.Fprintf(r.w, "%s\n", e.Data)
+		r.midLine = false
+	case eventExit:
+		if r.midLine && (e.Error != "" || e.ExitCode != nil) {
+			_, err = io.WriteString(r.w, "\n")
+			r.midLine = false
+		}
+		if err == nil && e.Error != "" {
+			_, err = fmt.Fprintf(r.w, "%s\n", e.Error)
+		}
+		if err == nil && e.ExitCode != nil {
+			_, err = fmt.Fprintf(r.w, "# exit=%d%s time=%s user=%s sys=%s maxrss=%dKiB cwd=%s\n",
+				*e.ExitCode, pipeStatus(e.PipeStatus), seconds(e.Duration), seconds(e.UserTime), seconds(e.SysTime), e.MaxRSS/1024, e.Cwd)
+		}
+	case eventEnv:
+		if r.midLine {
+			_, err = io.WriteString(r.w, "\n")
+			r.midLine = false
+		}
+		if err != nil {
+			break
+		}
+		if e.Value != nil {
+			_, err = fmt.Fprintf(r.w, "# env %s=%s\n", e.Name, *e.Value)
+		} else {
+			_, err = fmt.Fprintf(r.w, "# env unset %s\n", e.Name)
+		}
+	}
+	return err
+}
+
+// pipeStatus formats the exit status of each stage of a pipeline for a
+// [TranscriptText] annotation.
+func pipeStatus(codes []int) string {
+	if len(codes) == 0 {
+		return ""
+	}
+	status := make([]string, len(codes))
+	for i, code := range codes {
+		status[i] = strconv.Itoa(code)
+	}
+	return " pipestatus=" + strings.Join(status, ",")
+}
+
+// tagLines prefixes each line in data with [stderrTag], except the
+// first if it continues a line that was already tagged.
+func tagLines(data string, continued bool) string {
+	lines := strings.SplitAfter(data, "\n")
+	for i, line := range lines {
+		if line == "" || (i == 0 && continued) {
+			continue
+		}
+		lines[i] = stderrTag + line
+	}
+	return strings.Join(lines, "")
+}
+
+// seconds converts a number of seconds from an [event] to a
+// [time.Duration] rounded for display.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
+
+// jsonlRecorder writes the [TranscriptJSONL] format. Prompts are left
+// out as they carry no information.
+type jsonlRecorder struct {
+	enc *json.Encoder
+}
+
+func (r jsonlRecorder) record(e event) error {
+	if e.Type == eventPrompt {
+		return nil
+	}
+	return r.enc.Encode(e)
+}
+
+// asciicastRecorder writes the [TranscriptAsciicast] format: a header
+// line followed by one [time, code, data] array per line, where time is
+// in seconds since the start of the session. Input is recorded both as
+// an "i" event and as echoed "o" output, as the client echoes it
+// locally rather than through the session.
+type asciicastRecorder struct {
+	w     io.Writer
+	start time.Time
+}
+
+// Terminal size assumed for asciicast recordings, as shellspy has no
+// way to learn the size of the client terminal.
+const (
+	asciicastWidth  = 80
+	asciicastHeight = 24
+)
+
+func (r *asciicastRecorder) record(e event) error {
+	switch e.Type {
+	case eventStart:
+		r.start = e.Time
+		term := os.Getenv("TERM")
+		if term == "" {
+			term = "xterm"
+		}
+		return r.write(map[string]any{
+			"version":   2,
+			"width":     asciicastWidth,
+			"height":    asciicastHeight,
+			"timestamp": e.Time.Unix(),
+			"env":       map[string]string{"SHELL": "shellspy", "TERM": term},
+		})
+	case eventPrompt, eventOutput:
+		return r.event(e.Time, "o", e.Data)
+	case eventInput:
+		err := r.event(e.Time, "i", e.Data+"\n")
+		if err != nil {
+			return err
+		}
+		return r.event(e.Time, "o", e.Data+"\n")
+	case eventExit:
+		if e.Error != "" {
+			return r.event(e.Time, "o", e.Error+"\n")
+		}
+	}
+	return nil
+}
+
+// event writes an event, translating newlines for output.
+func (r *asciicastRecorder) event(t time.Time, code, data string) error {
+	if code == "o" {
+		data = terminalNewlines(data)
+	}
+	return r.write([]any{t.Sub(r.start).Seconds(), code, data})
+}
+
+func (r *asciicastRecorder) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", data)
+	return err
+}
+
+// scriptRecorder writes the [TranscriptScript] format. The typescript
+// holds everything that appeared on the terminal, including echoed
+// input, and each entry in the timing file is "O", the delay in seconds
+// since the previous entry and the number of bytes written.
+type scriptRecorder struct {
+	w      io.Writer
+	timing io.Writer
+	last   time.Time
+}
+
+func (r *scriptRecorder) record(e event) error {
+	switch e.Type {
+	case eventStart:
+		r.last = e.Time
+		_, err := fmt.Fprintf(r.w, "Script started on %s [COMMAND=\"shellspy\"]\n", e.Time.Format("2006-01-02 15:04:05-07:00"))
+		return err
+	case eventPrompt, eventOutput:
+		return r.output(e.Time, e.Data)
+	case eventInput:
+		return r.output(e.Time, e.Data+"\n")
+	case eventExit:
+		if e.Error != "" {
+			return r.output(e.Time, e.Error+"\n")
+		}
+	case eventEnd:
+		_, err := fmt.Fprintf(r.w, "\nScript done on %s\n", e.Time.Format("2006-01-02 15:04:05-07:00"))
+		return err
+	}
+	return nil
+}
+
+func (r *scriptRecorder) output(t time.Time, data string) error {
+	n, err := io.WriteString(r.w, terminalNewlines(data))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.timing, "O %.6f %d\n", t.Sub(r.last).Seconds(), n)
+	r.last = t
+	return err
+}
+
+// terminalNewlines translates newlines in data to the carriage return
+// and line feed a terminal expects when replaying it.
+func terminalNewlines(data string) string {
+	return strings.ReplaceAll(data, "\n", "\r\n")
+}
+
+// streamWriter is an [io.Writer] for one output stream of a session.
+// Everything written goes to the terminal, wrapped in color if set, and
+// is recorded in the transcript. It is safe for concurrent use with
+// other streamWriters sharing the same mutex.
+type streamWriter struct {
+	mu       *sync.Mutex
+	terminal io.Writer
+	recorder recorder
+	stream   string
+	color    string
+}
+
+// ANSI escape sequences for coloring terminal output.
+const (
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	if w.color != "" {
+		_, err = io.WriteString(w.terminal, w.color+string(p)+colorReset)
+	} else {
+		_, err = w.terminal.Write(p)
+	}
+	w.recorder.record(event{Time: time.Now(), Type: eventOutput, Stream: w.stream, Data: string(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}